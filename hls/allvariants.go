@@ -0,0 +1,175 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "fmt"
+import "log"
+import "net/url"
+import "path/filepath"
+import "sync"
+import "time"
+
+// acquireSlot waits for one of the -max-parallel slots limiting the segments
+// downloaded at the same time across all playlists being recorded.
+func (d *Downloader) acquireSlot(ctx context.Context) bool {
+	if d.slots == nil {
+		return true
+	}
+	select {
+	case d.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (d *Downloader) releaseSlot() {
+	if d.slots != nil {
+		<-d.slots
+	}
+}
+
+const variantReportInterval = 30 * time.Second
+
+// variantRecording is one variant of an -all-variants recording.
+type variantRecording struct {
+	label string
+	URI   string
+	file  string
+
+	mu       sync.Mutex
+	segments int
+	recorded time.Duration
+}
+
+func (r *variantRecording) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fmt.Sprintf("%v: %v segments, %v recorded to %v", r.label, r.segments, r.recorded, r.file)
+}
+
+// variantLabel names a variant after its resolution and bandwidth, e.g.
+// 1280x720-2000k.
+func variantLabel(resolution string, bandwidth uint32) string {
+	if resolution == "" {
+		return fmt.Sprintf("%vk", bandwidth/1000)
+	}
+	return fmt.Sprintf("%v-%vk", resolution, bandwidth/1000)
+}
+
+// variantFileName inserts the variant label before the extension, e.g.
+// out.1280x720-2000k.ts.
+func variantFileName(fn, label string) string {
+	ext := filepath.Ext(fn)
+	return fmt.Sprintf("%v.%v%v", fn[:len(fn)-len(ext)], label, ext)
+}
+
+// recordAllVariants records every variant of a master playlist within the
+// bandwidth limits at once, each to its own output file.
+func (d *Downloader) recordAllVariants(ctx context.Context, masterURI, fn string) {
+	masterURL, err := url.Parse(masterURI)
+	if err != nil {
+		d.fail(err)
+		return
+	}
+	mpl, baseURL, err := d.fetchMaster(ctx, masterURL)
+	if err != nil {
+		d.fail(fmt.Errorf("-all-variants needs a master playlist. %w", err))
+		return
+	}
+
+	var recordings []*variantRecording
+	seen := map[string]int{}
+	for _, v := range mpl.Variants {
+		if v == nil || v.Iframe {
+			continue
+		}
+		bw := uint(v.Bandwidth)
+		if bw < d.MinBandwidth || (d.MaxBandwidth != 0 && bw > d.MaxBandwidth) {
+			continue
+		}
+		u, err := baseURL.Parse(v.URI)
+		if err != nil {
+			d.fail(err)
+			return
+		}
+		label := variantLabel(v.Resolution, v.Bandwidth)
+		seen[label]++
+		if seen[label] > 1 {
+			label = fmt.Sprintf("%v-%v", label, seen[label])
+		}
+		recordings = append(recordings, &variantRecording{
+			label: label,
+			URI:   u.String(),
+			file:  variantFileName(fn, label),
+		})
+	}
+	if len(recordings) == 0 {
+		d.fail(fmt.Errorf("No variant with bandwidth between %v and %v", d.MinBandwidth, bandwidthLimit(d.MaxBandwidth)))
+		return
+	}
+	log.Printf("Recording %v variants.\n", len(recordings))
+
+	var wg sync.WaitGroup
+	for _, r := range recordings {
+		wg.Add(1)
+		go func(r *variantRecording) {
+			defer wg.Done()
+			queued := make(chan *segment, d.QueueSize)
+			dlc := make(chan *segment)
+			go d.getPlaylist(ctx, r.URI, queued)
+			go func() {
+				defer close(dlc)
+				for v := range queued {
+					select {
+					case dlc <- v:
+					case <-ctx.Done():
+						return
+					}
+					r.mu.Lock()
+					r.segments++
+					r.recorded = v.totalDuration
+					r.mu.Unlock()
+				}
+			}()
+			d.downloadSegment(ctx, r.file, dlc)
+		}(r)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(variantReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, r := range recordings {
+				log.Print(r)
+			}
+		case <-done:
+			for _, r := range recordings {
+				log.Print(r)
+			}
+			return
+		}
+	}
+}
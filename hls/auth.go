@@ -0,0 +1,96 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "fmt"
+import "log"
+import "net/http"
+import "os/exec"
+import "strings"
+import "sync"
+
+// tokenSource caches an access token obtained by running an external command,
+// refreshing it only after the server rejects the current one.
+type tokenSource struct {
+	cmd        string
+	mu         sync.Mutex
+	token      string
+	generation int
+}
+
+// get returns the cached token and its generation, fetching it on first use.
+func (t *tokenSource) get() (string, int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.generation == 0 {
+		if err := t.fetch(); err != nil {
+			return "", 0, err
+		}
+	}
+	return t.token, t.generation, nil
+}
+
+// refresh replaces a token of the given generation. If another request
+// refreshed it in the meantime, the newer token is returned as is.
+func (t *tokenSource) refresh(generation int) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.generation == generation {
+		if err := t.fetch(); err != nil {
+			return "", err
+		}
+	}
+	return t.token, nil
+}
+
+func (t *tokenSource) fetch() error {
+	out, err := shellCommand(t.cmd).Output()
+	if err != nil {
+		return fmt.Errorf("%w: token command failed: %v", ErrAuth, err)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return fmt.Errorf("%w: token command printed no token", ErrAuth)
+	}
+	t.token = token
+	t.generation++
+	log.Printf("Fetched access token (generation %v).\n", t.generation)
+	return nil
+}
+
+// shellCommand runs cmd as typed at the prompt of the platform's shell, sh or
+// cmd.exe on Windows.
+func shellCommand(cmd string) *exec.Cmd {
+	if windows {
+		return exec.Command("cmd", "/C", cmd)
+	}
+	return exec.Command("sh", "-c", cmd)
+}
+
+// authorization formats a token for the Authorization header. Tokens that
+// already name a scheme, e.g. "Basic ...", are used verbatim.
+func authorization(token string) string {
+	if strings.Contains(token, " ") {
+		return token
+	}
+	return "Bearer " + token
+}
+
+func authFailed(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+}
@@ -0,0 +1,92 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "log"
+import "time"
+
+// -auto-concurrency starts with this many workers.
+const autoConcurrencyStart = 2
+
+// and goes up to this many unless -concurrency gives a higher ceiling.
+const autoConcurrencyMax = 16
+
+// concurrencyTuner adjusts the number of segments downloaded at the same
+// time for -auto-concurrency. It adds a worker while that raises the
+// throughput, and removes one when segments take much longer than they did
+// at best, which means the server or the link is saturated.
+type concurrencyTuner struct {
+	limit int
+	max   int
+
+	start   time.Time // of the current measuring window
+	bytes   int64
+	count   int
+	latency time.Duration
+
+	lastRate    float64 // bytes/s of the previous window
+	bestLatency time.Duration
+	raised      bool // whether the last change added a worker
+}
+
+func newConcurrencyTuner(max int) *concurrencyTuner {
+	if max < autoConcurrencyMax {
+		max = autoConcurrencyMax
+	}
+	return &concurrencyTuner{limit: autoConcurrencyStart, max: max, start: time.Now()}
+}
+
+// add records a downloaded segment and returns the new number of workers at
+// the end of a window, or 0 to keep it.
+func (t *concurrencyTuner) add(size int64, latency time.Duration) int {
+	t.bytes += size
+	t.count++
+	t.latency += latency
+	if t.count < 2*t.limit {
+		return 0
+	}
+	elapsed := time.Now().Sub(t.start)
+	if elapsed <= 0 {
+		return 0
+	}
+	rate := float64(t.bytes) / elapsed.Seconds()
+	avg := t.latency / time.Duration(t.count)
+	if t.bestLatency == 0 || avg < t.bestLatency {
+		t.bestLatency = avg
+	}
+
+	next := t.limit
+	switch {
+	case avg > 2*t.bestLatency && t.limit > 1:
+		next--
+	case t.raised && rate < 0.95*t.lastRate && t.limit > 1:
+		// The last worker added did not help.
+		next--
+	case rate > 1.1*t.lastRate && t.limit < t.max:
+		next++
+	}
+	if next != t.limit {
+		log.Printf("Concurrency %v -> %v at %v kB/s and %v per segment.\n",
+			t.limit, next, int64(rate/1000), avg.Round(time.Millisecond))
+	}
+	t.raised = next > t.limit
+	t.limit = next
+	t.lastRate = rate
+	t.start, t.bytes, t.count, t.latency = time.Now(), 0, 0, 0
+	return next
+}
@@ -0,0 +1,213 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bufio"
+import "context"
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "io"
+import "log"
+import "net/http"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "time"
+
+type requestKindKey struct{}
+
+// withRequestKind tells the -cache-dir transport what a request fetches.
+func withRequestKind(ctx context.Context, kind requestKind) context.Context {
+	return context.WithValue(ctx, requestKindKey{}, kind)
+}
+
+// cacheTransport keeps GET responses in -cache-dir, keyed by URL and range,
+// so repeated downloads of the same VOD skip unchanged segments. Cached
+// responses are used while Cache-Control or Expires says they are fresh and
+// revalidated with If-None-Match or If-Modified-Since after that. With
+// always, segments and keys are used from the cache without asking the
+// server at all.
+type cacheTransport struct {
+	next   http.RoundTripper
+	dir    string
+	always bool
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return t.next.RoundTrip(req)
+	}
+	fn := t.path(req)
+	cached, stored, err := t.load(fn, req)
+	if err != nil {
+		return t.store(fn, req)
+	}
+	kind, known := req.Context().Value(requestKindKey{}).(requestKind)
+	if t.always && known && kind != playlistRequest || fresh(cached.Header, stored) {
+		return cached, nil
+	}
+
+	etag := cached.Header.Get("ETag")
+	modified := cached.Header.Get("Last-Modified")
+	if etag == "" && modified == "" {
+		cached.Body.Close()
+		return t.store(fn, req)
+	}
+	check := req.Clone(req.Context())
+	if etag != "" {
+		check.Header.Set("If-None-Match", etag)
+	}
+	if modified != "" {
+		check.Header.Set("If-Modified-Since", modified)
+	}
+	resp, err := t.next.RoundTrip(check)
+	if err != nil || resp.StatusCode != http.StatusNotModified {
+		cached.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		return t.keep(fn, resp), nil
+	}
+	resp.Body.Close()
+	now := time.Now()
+	os.Chtimes(fn, now, now)
+	return cached, nil
+}
+
+// path returns the cache file for req.
+func (t *cacheTransport) path(req *http.Request) string {
+	key := req.URL.String()
+	if r := req.Header.Get("Range"); r != "" {
+		key += " " + r
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(t.dir, hex.EncodeToString(sum[:]))
+}
+
+// load opens the cached response in fn and returns it with the time it was
+// stored or last revalidated.
+func (t *cacheTransport) load(fn string, req *http.Request) (*http.Response, time.Time, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(f), req)
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{resp.Body, f}
+	return resp, info.ModTime(), nil
+}
+
+// fresh tells whether a response stored at the given time may still be used
+// without asking the server.
+func fresh(h http.Header, stored time.Time) bool {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		if directive == "no-cache" {
+			return false
+		}
+		if strings.HasPrefix(directive, "max-age=") {
+			age, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			return err == nil && time.Since(stored) < time.Duration(age)*time.Second
+		}
+	}
+	expires, err := http.ParseTime(h.Get("Expires"))
+	return err == nil && time.Now().Before(expires)
+}
+
+func (t *cacheTransport) store(fn string, req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return t.keep(fn, resp), nil
+}
+
+// keep arranges for resp to be written to the cache file fn as it is read.
+// The file only replaces fn once the whole body came in.
+func (t *cacheTransport) keep(fn string, resp *http.Response) *http.Response {
+	if resp.StatusCode != 200 && resp.StatusCode != http.StatusPartialContent ||
+		strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-store") {
+		return resp
+	}
+	f, err := os.CreateTemp(t.dir, ".tmp-")
+	if err != nil {
+		log.Printf("Could not cache %v. %v\n", resp.Request.URL, err)
+		return resp
+	}
+	// The body is stored as received, without chunked encoding.
+	header := resp.Header.Clone()
+	if resp.ContentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	fmt.Fprintf(f, "HTTP/1.1 %v\r\n", resp.Status)
+	header.Write(f)
+	if _, err := io.WriteString(f, "\r\n"); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return resp
+	}
+	resp.Body = &cacheWriter{body: resp.Body, f: f, fn: fn, size: resp.ContentLength}
+	return resp
+}
+
+// cacheWriter copies a response body to the cache as it is read.
+type cacheWriter struct {
+	body    io.ReadCloser
+	f       *os.File
+	fn      string
+	size    int64 // -1 if unknown
+	written int64
+	failed  bool
+	done    bool
+}
+
+func (c *cacheWriter) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if n > 0 && !c.failed {
+		if _, werr := c.f.Write(p[:n]); werr != nil {
+			c.failed = true
+		}
+		c.written += int64(n)
+	}
+	if err == io.EOF {
+		c.done = c.size < 0 || c.written == c.size
+	}
+	return n, err
+}
+
+func (c *cacheWriter) Close() error {
+	err := c.body.Close()
+	name := c.f.Name()
+	if c.f.Close() != nil || c.failed || !c.done || os.Rename(name, c.fn) != nil {
+		os.Remove(name)
+	}
+	return err
+}
@@ -0,0 +1,494 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bufio"
+import "bytes"
+import "fmt"
+import "log"
+import "os"
+import "sort"
+import "strings"
+import "time"
+
+// Caption data is carried in the order frames are decoded, which differs
+// from the order they are shown in when there are B-frames. Up to this many
+// frames are held back to put it in presentation order.
+const captionReorderDepth = 16
+
+// SEI payload of type user_data_registered_itu_t_t35 carrying ATSC A/53
+// caption data.
+const seiUserDataRegistered = 4
+
+var atscCaptionHeader = []byte{0xb5, 0x00, 0x31, 'G', 'A', '9', '4', 0x03}
+
+// captionExtractor writes the CEA-608 captions (CC1) embedded in the H.264
+// or H.265 video of the MPEG-TS written to it to a WebVTT file.
+type captionExtractor struct {
+	fn       string
+	pmtPIDs  map[uint16]bool
+	videoPID uint16
+	hevc     bool
+	pes      []byte
+	pesPTS   int64 // -1 if the PES packet has no PTS
+	frames   []captionFrame
+	base     int64 // PTS at time 0
+	last     time.Duration
+	decoder  cea608
+	f        *os.File
+	w        *bufio.Writer
+	cues     int
+	tsPacketizer
+}
+
+// captionFrame is the caption data of one video frame.
+type captionFrame struct {
+	pts   int64
+	pairs [][2]byte
+}
+
+func newCaptionExtractor(fn string) *captionExtractor {
+	c := &captionExtractor{fn: fn, pmtPIDs: map[uint16]bool{}, base: -1}
+	c.handle = c.packet
+	c.decoder.cue = c.writeCue
+	return c
+}
+
+func (c *captionExtractor) packet(p tsPacket) error {
+	pid := p.pid()
+	switch {
+	case pid == patPID:
+		if p.unitStart() {
+			for _, pmt := range parsePAT(psiSection(p.payload())) {
+				c.pmtPIDs[pmt] = true
+			}
+		}
+	case c.pmtPIDs[pid]:
+		if p.unitStart() && c.videoPID == 0 {
+			for _, s := range parsePMT(psiSection(p.payload())) {
+				if s.streamType == streamTypeH264 || s.streamType == streamTypeH265 {
+					c.videoPID = s.pid
+					c.hevc = s.streamType == streamTypeH265
+					break
+				}
+			}
+		}
+	case pid == c.videoPID && pid != 0:
+		payload := p.payload()
+		if p.unitStart() {
+			if err := c.endPES(); err != nil {
+				return err
+			}
+			c.pesPTS = pesPTS(payload)
+			payload = pesPayload(payload)
+		}
+		c.pes = append(c.pes, payload...)
+	}
+	return nil
+}
+
+// pesPTS returns the presentation timestamp of a PES packet in 90 kHz
+// units, or -1 if it has none.
+func pesPTS(payload []byte) int64 {
+	if len(payload) < 14 || payload[7]&0x80 == 0 {
+		return -1
+	}
+	return int64(payload[9]>>1&0x07)<<30 | int64(payload[10])<<22 | int64(payload[11]>>1)<<15 |
+		int64(payload[12])<<7 | int64(payload[13]>>1)
+}
+
+// endPES looks for caption data in the video PES packet collected so far.
+func (c *captionExtractor) endPES() error {
+	defer func() { c.pes = c.pes[:0] }()
+	if c.pesPTS < 0 {
+		return nil
+	}
+	var pairs [][2]byte
+	for _, nal := range splitNALUnits(c.pes) {
+		pairs = append(pairs, c.seiCaptions(nal)...)
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	c.frames = append(c.frames, captionFrame{c.pesPTS, pairs})
+	if len(c.frames) > captionReorderDepth {
+		return c.decodeFrames(len(c.frames) - captionReorderDepth)
+	}
+	return nil
+}
+
+// decodeFrames passes the caption data of the n earliest frames held back
+// to the decoder.
+func (c *captionExtractor) decodeFrames(n int) error {
+	sort.SliceStable(c.frames, func(i, j int) bool { return c.frames[i].pts < c.frames[j].pts })
+	for _, f := range c.frames[:n] {
+		t := c.time(f.pts)
+		for _, pair := range f.pairs {
+			c.decoder.decode(pair[0], pair[1], t)
+		}
+	}
+	c.frames = append(c.frames[:0], c.frames[n:]...)
+	if c.w != nil {
+		return c.w.Flush()
+	}
+	return nil
+}
+
+// time turns a PTS into the time since the first one. Jumps, e.g. at a
+// discontinuity, continue from the last time instead.
+func (c *captionExtractor) time(pts int64) time.Duration {
+	if c.base < 0 {
+		c.base = pts
+	}
+	t := time.Duration(pts-c.base) * time.Second / 90000
+	if t < c.last || t > c.last+10*time.Second {
+		c.base = pts - int64(c.last*90000/time.Second)
+		t = c.last
+	}
+	c.last = t
+	return t
+}
+
+// splitNALUnits splits an Annex B byte stream at its start codes.
+func splitNALUnits(b []byte) [][]byte {
+	var units [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			units = append(units, bytes.TrimRight(b[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(b) {
+		units = append(units, b[start:])
+	}
+	return units
+}
+
+// seiCaptions returns the field 1 CEA-608 byte pairs in an SEI NAL unit.
+func (c *captionExtractor) seiCaptions(nal []byte) [][2]byte {
+	if len(nal) < 2 {
+		return nil
+	}
+	if c.hevc {
+		// Prefix SEI, with a two byte header.
+		if nal[0]>>1&0x3f != 39 || len(nal) < 3 {
+			return nil
+		}
+		nal = nal[2:]
+	} else {
+		if nal[0]&0x1f != 6 {
+			return nil
+		}
+		nal = nal[1:]
+	}
+	rbsp := unescapeRBSP(nal)
+	var pairs [][2]byte
+	for len(rbsp) > 2 {
+		payloadType, n := seiValue(rbsp)
+		rbsp = rbsp[n:]
+		size, n := seiValue(rbsp)
+		rbsp = rbsp[n:]
+		if size > len(rbsp) {
+			break
+		}
+		if payloadType == seiUserDataRegistered {
+			pairs = append(pairs, atscCaptions(rbsp[:size])...)
+		}
+		rbsp = rbsp[size:]
+	}
+	return pairs
+}
+
+// seiValue reads an SEI payload type or size, coded as a run of 0xff bytes
+// that are added up.
+func seiValue(b []byte) (value, n int) {
+	for n < len(b) {
+		value += int(b[n])
+		n++
+		if b[n-1] != 0xff {
+			break
+		}
+	}
+	return value, n
+}
+
+// unescapeRBSP removes the emulation prevention bytes from a NAL unit.
+func unescapeRBSP(b []byte) []byte {
+	if !bytes.Contains(b, []byte{0, 0, 3}) {
+		return b
+	}
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, x := range b {
+		if zeros >= 2 && x == 3 {
+			zeros = 0
+			continue
+		}
+		if x == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, x)
+	}
+	return out
+}
+
+// atscCaptions returns the valid NTSC field 1 byte pairs of an ATSC A/53
+// cc_data structure.
+func atscCaptions(b []byte) [][2]byte {
+	if !bytes.HasPrefix(b, atscCaptionHeader) || len(b) < len(atscCaptionHeader)+2 {
+		return nil
+	}
+	b = b[len(atscCaptionHeader):]
+	count := int(b[0] & 0x1f)
+	b = b[2:]
+	var pairs [][2]byte
+	for i := 0; i < count && 3*i+2 < len(b); i++ {
+		header := b[3*i]
+		valid := header&0x04 != 0
+		if valid && header&0x03 == 0 {
+			pairs = append(pairs, [2]byte{b[3*i+1] & 0x7f, b[3*i+2] & 0x7f})
+		}
+	}
+	return pairs
+}
+
+func (c *captionExtractor) writeCue(start, end time.Duration, text string) {
+	if c.f == nil {
+		var err error
+		c.f, err = os.Create(c.fn)
+		if err != nil {
+			log.Printf("Could not write captions. %v\n", err)
+			c.decoder.cue = func(time.Duration, time.Duration, string) {}
+			return
+		}
+		log.Printf("Writing captions to %v.\n", c.fn)
+		c.w = bufio.NewWriter(c.f)
+		c.w.WriteString("WEBVTT\n\n")
+	}
+	c.cues++
+	fmt.Fprintf(c.w, "%v --> %v\n%v\n\n", vttTime(start), vttTime(end), text)
+}
+
+func vttTime(t time.Duration) string {
+	ms := t.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func (c *captionExtractor) Close() error {
+	c.endPES()
+	c.decodeFrames(len(c.frames))
+	c.decoder.flush(c.last)
+	if c.f == nil {
+		if c.videoPID != 0 {
+			log.Print("Found no CEA-608 captions to extract.")
+		}
+		return nil
+	}
+	log.Printf("Wrote %v captions to %v.\n", c.cues, c.fn)
+	if err := c.w.Flush(); err != nil {
+		c.f.Close()
+		return err
+	}
+	return c.f.Close()
+}
+
+// CEA-608 caption modes.
+const (
+	popOn = iota
+	rollUp
+	paintOn
+)
+
+// cea608 decodes the byte pairs of caption channel 1 into cues. Positioning
+// and styling are dropped; rows become lines.
+type cea608 struct {
+	channel  int // data channel of the last control code
+	lastCtrl [2]byte
+	mode     int
+	rollRows int
+	back     []string // pop-on captions are built off screen
+	front    []string
+	text     string // the caption on screen
+	start    time.Duration
+	cue      func(start, end time.Duration, text string)
+}
+
+var basicChars = map[byte]string{
+	0x2a: "á", 0x5c: "é", 0x5e: "í", 0x5f: "ó", 0x60: "ú",
+	0x7b: "ç", 0x7c: "÷", 0x7d: "Ñ", 0x7e: "ñ", 0x7f: "■",
+}
+
+var specialChars = []string{"®", "°", "½", "¿", "™", "¢", "£", "♪", "à", " ", "è", "â", "ê", "î", "ô", "û"}
+
+var extendedChars = map[byte][]string{
+	0x12: {"Á", "É", "Ó", "Ú", "Ü", "ü", "‘", "¡", "*", "'", "—", "©", "℠", "•", "“", "”",
+		"À", "Â", "Ç", "È", "Ê", "Ë", "ë", "Î", "Ï", "ï", "Ô", "Ù", "ù", "Û", "«", "»"},
+	0x13: {"Ã", "ã", "Í", "Ì", "ì", "Ò", "ò", "Õ", "õ", "{", "}", "\\", "^", "_", "|", "~",
+		"Ä", "ä", "Ö", "ö", "ß", "¥", "¤", "│", "Å", "å", "Ø", "ø", "┌", "┐", "└", "┘"},
+}
+
+func (c *cea608) decode(b1, b2 byte, t time.Duration) {
+	if b1 == 0 && b2 == 0 {
+		return
+	}
+	if b1 < 0x10 || b1 > 0x1f {
+		c.lastCtrl = [2]byte{}
+		if c.channel != 1 || b1 < 0x20 {
+			return
+		}
+		c.addChar(basicChar(b1))
+		if b2 >= 0x20 {
+			c.addChar(basicChar(b2))
+		}
+		return
+	}
+
+	// Control codes are sent twice in a row for robustness.
+	if c.lastCtrl == [2]byte{b1, b2} {
+		c.lastCtrl = [2]byte{}
+		return
+	}
+	c.lastCtrl = [2]byte{b1, b2}
+	c.channel = 1
+	if b1&0x08 != 0 {
+		c.channel = 2
+		return
+	}
+
+	switch {
+	case (b1 == 0x14 || b1 == 0x15) && b2 >= 0x20 && b2 <= 0x2f:
+		c.command(b2, t)
+	case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3f:
+		c.addChar(specialChars[b2-0x30])
+	case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2f:
+		// Mid-row style changes take up a space.
+		c.addChar(" ")
+	case (b1 == 0x12 || b1 == 0x13) && b2 >= 0x20 && b2 <= 0x3f:
+		// Extended characters replace the standard one sent before them.
+		c.backspace()
+		c.addChar(extendedChars[b1][b2-0x20])
+	case b2 >= 0x40:
+		// A preamble address code moves to another row.
+		c.newLine()
+	}
+}
+
+func basicChar(b byte) string {
+	if s, ok := basicChars[b]; ok {
+		return s
+	}
+	return string(rune(b))
+}
+
+func (c *cea608) command(cmd byte, t time.Duration) {
+	switch cmd {
+	case 0x20: // resume caption loading
+		c.mode = popOn
+	case 0x25, 0x26, 0x27: // roll-up with 2 to 4 rows
+		c.mode = rollUp
+		c.rollRows = int(cmd-0x25) + 2
+	case 0x29: // resume direct captioning
+		c.mode = paintOn
+	case 0x21: // backspace
+		c.backspace()
+	case 0x2c: // erase displayed memory
+		c.front = nil
+		c.show(t)
+	case 0x2d: // carriage return
+		if c.mode == popOn {
+			return
+		}
+		if c.mode == rollUp && len(c.front) >= c.rollRows {
+			c.front = c.front[len(c.front)-c.rollRows+1:]
+		}
+		c.show(t)
+		c.front = append(c.front, "")
+	case 0x2e: // erase non-displayed memory
+		c.back = nil
+	case 0x2f: // end of caption, flipping the memories
+		c.front, c.back = c.back, c.front
+		c.show(t)
+	}
+}
+
+// buffer returns the memory characters go to in the current mode.
+func (c *cea608) buffer() *[]string {
+	if c.mode == popOn {
+		return &c.back
+	}
+	return &c.front
+}
+
+func (c *cea608) addChar(s string) {
+	b := c.buffer()
+	if len(*b) == 0 {
+		*b = append(*b, "")
+	}
+	(*b)[len(*b)-1] += s
+}
+
+func (c *cea608) backspace() {
+	b := c.buffer()
+	if len(*b) == 0 {
+		return
+	}
+	line := []rune((*b)[len(*b)-1])
+	if len(line) > 0 {
+		(*b)[len(*b)-1] = string(line[:len(line)-1])
+	}
+}
+
+func (c *cea608) newLine() {
+	b := c.buffer()
+	if len(*b) > 0 && strings.TrimSpace((*b)[len(*b)-1]) != "" {
+		*b = append(*b, "")
+	}
+}
+
+// show puts the displayed memory on screen at t, ending the previous cue.
+func (c *cea608) show(t time.Duration) {
+	var lines []string
+	for _, line := range c.front {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	text := strings.Join(lines, "\n")
+	if text == c.text {
+		return
+	}
+	if c.text != "" && t > c.start {
+		c.cue(c.start, t, c.text)
+	}
+	c.text, c.start = text, t
+}
+
+// flush ends the caption on screen at t.
+func (c *cea608) flush(t time.Duration) {
+	if c.text != "" && t > c.start {
+		c.cue(c.start, t, c.text)
+	}
+	c.text = ""
+}
@@ -0,0 +1,74 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "log"
+import "net/http/httptrace"
+import "sync"
+
+// Connection reuse is judged over windows of this many segment requests.
+const connWindow = 20
+
+// Warn when fewer than this fraction of a window's requests reused a
+// keep-alive connection.
+const minConnReuse = 0.5
+
+// connStats counts how often segment requests get a fresh connection, which
+// is slow and usually means keep-alive is not working.
+type connStats struct {
+	mu     sync.Mutex
+	total  int
+	reused int
+	closed int // responses with Connection: close
+}
+
+func (c *connStats) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.total++
+			if info.Reused {
+				c.reused++
+			}
+		},
+	}
+}
+
+// done records whether the server asked to close the connection and checks
+// the reuse ratio at the end of each window.
+func (c *connStats) done(closed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if closed {
+		c.closed++
+	}
+	if c.total < connWindow {
+		return
+	}
+	if float64(c.reused)/float64(c.total) < minConnReuse {
+		log.Printf("Only %v of the last %v segment requests reused a connection, which slows downloads down.\n",
+			c.reused, c.total)
+		if c.closed > c.total/2 {
+			log.Print("The server is sending Connection: close.")
+		} else {
+			log.Print("Check for proxies or transport settings that disable keep-alive.")
+		}
+	}
+	c.total, c.reused, c.closed = 0, 0, 0
+}
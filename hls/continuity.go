@@ -0,0 +1,109 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bufio"
+import "io"
+import "log"
+import "os"
+import "sort"
+
+// ccError counts the continuity counter errors of one PID.
+type ccError struct {
+	count int
+	first int64 // byte offset of the first one
+}
+
+// continuityChecker follows the continuity counters of the PIDs of an
+// MPEG-TS stream for -validate-cc. The counter goes up by one with every
+// packet carrying payload; a repeated packet may keep it once.
+type continuityChecker struct {
+	last     map[uint16]byte
+	repeated map[uint16]bool
+	errors   map[uint16]*ccError
+	offset   int64
+}
+
+func newContinuityChecker() *continuityChecker {
+	return &continuityChecker{
+		last:     map[uint16]byte{},
+		repeated: map[uint16]bool{},
+		errors:   map[uint16]*ccError{},
+	}
+}
+
+func (c *continuityChecker) packet(p tsPacket) error {
+	defer func() { c.offset += tsPacketSize }()
+	pid := p.pid()
+	if pid == nullPID {
+		return nil
+	}
+	cc := p.continuity()
+	last, seen := c.last[pid]
+	c.last[pid] = cc
+	// The discontinuity indicator allows the counter to jump.
+	if !seen || p[3]&0x20 != 0 && p[4] > 0 && p[5]&0x80 != 0 {
+		c.repeated[pid] = false
+		return nil
+	}
+	switch {
+	case !p.hasPayload() && cc == last:
+	case p.hasPayload() && cc == (last+1)&0x0f:
+		c.repeated[pid] = false
+	case p.hasPayload() && cc == last && !c.repeated[pid]:
+		c.repeated[pid] = true
+	default:
+		e := c.errors[pid]
+		if e == nil {
+			e = &ccError{first: c.offset}
+			c.errors[pid] = e
+		}
+		e.count++
+	}
+	return nil
+}
+
+// validateContinuity scans the MPEG-TS file fn and logs the continuity
+// counter errors of each PID, which show packets lost or put out of order.
+func validateContinuity(fn string) {
+	f, err := os.Open(fn)
+	if err != nil {
+		log.Printf("Could not validate continuity counters. %v\n", err)
+		return
+	}
+	defer f.Close()
+	c := newContinuityChecker()
+	t := &tsPacketizer{handle: c.packet}
+	if _, err := io.Copy(t, bufio.NewReader(f)); err != nil {
+		log.Printf("Could not validate continuity counters of %v. %v\n", fn, err)
+		return
+	}
+	if len(c.errors) == 0 {
+		log.Printf("Continuity counters of %v are correct (%v PIDs).\n", fn, len(c.last))
+		return
+	}
+	var pids []int
+	for pid := range c.errors {
+		pids = append(pids, int(pid))
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		e := c.errors[uint16(pid)]
+		log.Printf("%v: PID %v has %v continuity counter errors, the first at byte %v.\n", fn, pid, e.count, e.first)
+	}
+}
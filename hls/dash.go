@@ -0,0 +1,501 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "encoding/xml"
+import "fmt"
+import "log"
+import "mime"
+import "net/url"
+import "path"
+import "regexp"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "github.com/golang/groupcache/lru"
+
+// The subset of an MPEG-DASH manifest (MPD) needed to find the segments of
+// a representation. Only SegmentTemplate addressing, with or without a
+// SegmentTimeline, and single file representations are supported.
+type mpd struct {
+	Type                      string      `xml:"type,attr"`
+	AvailabilityStartTime     string      `xml:"availabilityStartTime,attr"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+	MinimumUpdatePeriod       string      `xml:"minimumUpdatePeriod,attr"`
+	BaseURL                   string      `xml:"BaseURL"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Start          string             `xml:"start,attr"`
+	Duration       string             `xml:"duration,attr"`
+	BaseURL        string             `xml:"BaseURL"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	MimeType        string              `xml:"mimeType,attr"`
+	ContentType     string              `xml:"contentType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       uint                `xml:"bandwidth,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	Width           int                 `xml:"width,attr"`
+	Height          int                 `xml:"height,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type mpdSegmentTemplate struct {
+	Timescale      uint64  `xml:"timescale,attr"`
+	Duration       uint64  `xml:"duration,attr"`
+	StartNumber    *uint64 `xml:"startNumber,attr"`
+	Media          string  `xml:"media,attr"`
+	Initialization string  `xml:"initialization,attr"`
+	Timeline       []mpdS  `xml:"SegmentTimeline>S"`
+}
+
+// mpdS is a SegmentTimeline entry: r+1 segments of duration d from time t.
+type mpdS struct {
+	T *uint64 `xml:"t,attr"`
+	D uint64  `xml:"d,attr"`
+	R int64   `xml:"r,attr"`
+}
+
+// dashSegment is one segment of a representation. Initialization segments
+// have no duration.
+type dashSegment struct {
+	URI      string
+	number   uint64
+	duration time.Duration
+}
+
+// isDASH reports whether the URL is an MPEG-DASH manifest, going by its
+// extension or else the Content-Type of a HEAD request.
+func (d *Downloader) isDASH(ctx context.Context, uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(path.Ext(u.Path)) {
+	case ".mpd":
+		return true
+	case ".m3u8", ".m3u":
+		return false
+	}
+	resp, err := d.headRequest(ctx, uri, playlistRequest)
+	if err != nil || resp.StatusCode != 200 {
+		return false
+	}
+	return isDASHType(resp.Header.Get("Content-Type"))
+}
+
+func isDASHType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/dash+xml"
+}
+
+var isoDuration = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses the ISO 8601 durations used in MPDs, e.g.
+// PT1H2M3.5S. Years and months are not supported.
+func parseISODuration(s string) (time.Duration, error) {
+	m := isoDuration.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("unsupported duration %q", s)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if m[i+1] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(m[i+1], 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(v * float64(unit))
+	}
+	return d, nil
+}
+
+var templateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth)(%0\d+d)?\$`)
+
+// expandTemplate fills in the $...$ identifiers of a SegmentTemplate URL.
+func expandTemplate(tpl string, rep *mpdRepresentation, number, t uint64) string {
+	s := templateIdentifier.ReplaceAllStringFunc(tpl, func(id string) string {
+		m := templateIdentifier.FindStringSubmatch(id)
+		format := m[2]
+		if format == "" {
+			format = "%d"
+		}
+		switch m[1] {
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			return fmt.Sprintf(format, number)
+		case "Time":
+			return fmt.Sprintf(format, t)
+		default:
+			return fmt.Sprintf(format, rep.Bandwidth)
+		}
+	})
+	return strings.Replace(s, "$$", "$", -1)
+}
+
+// resolveBase applies the BaseURL elements from the MPD down to the
+// representation, each relative to the one above.
+func resolveBase(base *url.URL, refs ...string) (*url.URL, error) {
+	for _, ref := range refs {
+		ref = strings.TrimSpace(ref)
+		if ref == "" {
+			continue
+		}
+		u, err := base.Parse(ref)
+		if err != nil {
+			return nil, err
+		}
+		base = u
+	}
+	return base, nil
+}
+
+// segments lists the segments of a representation, starting with its
+// initialization segment. For live manifests elapsed is the time since the
+// period became available, which ends the list at the live edge.
+func (t *mpdSegmentTemplate) segments(base *url.URL, rep *mpdRepresentation, periodDuration time.Duration, live bool, elapsed time.Duration) ([]dashSegment, error) {
+	var segs []dashSegment
+	add := func(tpl string, number, tm uint64, d time.Duration) error {
+		u, err := base.Parse(expandTemplate(tpl, rep, number, tm))
+		if err != nil {
+			return err
+		}
+		segs = append(segs, dashSegment{URI: u.String(), number: number, duration: d})
+		return nil
+	}
+	if t.Initialization != "" {
+		if err := add(t.Initialization, 0, 0, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	timescale := t.Timescale
+	if timescale == 0 {
+		timescale = 1
+	}
+	toDuration := func(units uint64) time.Duration {
+		return time.Duration(float64(units) / float64(timescale) * float64(time.Second))
+	}
+	number := uint64(1)
+	if t.StartNumber != nil {
+		number = *t.StartNumber
+	}
+
+	if len(t.Timeline) > 0 {
+		var tm uint64
+		for i, s := range t.Timeline {
+			if s.T != nil {
+				tm = *s.T
+			}
+			repeat := s.R
+			if repeat < 0 {
+				// Repeat up to the next entry, or the end of the period.
+				end := uint64(float64(periodDuration) / float64(time.Second) * float64(timescale))
+				if i+1 < len(t.Timeline) && t.Timeline[i+1].T != nil {
+					end = *t.Timeline[i+1].T
+				}
+				repeat = 0
+				if s.D > 0 && end > tm {
+					repeat = int64((end-tm+s.D-1)/s.D) - 1
+				}
+			}
+			for r := int64(0); r <= repeat; r++ {
+				if err := add(t.Media, number, tm, toDuration(s.D)); err != nil {
+					return nil, err
+				}
+				number++
+				tm += s.D
+			}
+		}
+		return segs, nil
+	}
+
+	if t.Duration == 0 {
+		return nil, fmt.Errorf("segment template of representation %v has neither a duration nor a timeline", rep.ID)
+	}
+	if !live && periodDuration <= 0 {
+		return nil, fmt.Errorf("%w: the length of the period of representation %v is unknown, so its number of segments is too", ErrPlaylistDecode, rep.ID)
+	}
+	d := toDuration(t.Duration)
+	count := uint64((periodDuration + d - 1) / d)
+	first := number
+	if live {
+		// Segments become available once complete. Start a few segments
+		// back from the live edge, as players do.
+		count = uint64(elapsed / d)
+		if count > 3 {
+			first = number + count - 3
+		}
+	}
+	for n := first; n < number+count; n++ {
+		if err := add(t.Media, n, (n-number)*t.Duration, d); err != nil {
+			return nil, err
+		}
+	}
+	return segs, nil
+}
+
+// kind tells the media type of an adaptation set, "video", "audio" or
+// something else.
+func (as *mpdAdaptationSet) kind() string {
+	if as.ContentType != "" {
+		return as.ContentType
+	}
+	mimeType := as.MimeType
+	if mimeType == "" && len(as.Representations) > 0 {
+		mimeType = as.Representations[0].MimeType
+	}
+	return strings.SplitN(mimeType, "/", 2)[0]
+}
+
+// selectRepresentation picks the highest bandwidth representation of the
+// given kind in a period, within -min-bandwidth and -max-bandwidth for video.
+func (d *Downloader) selectRepresentation(p *mpdPeriod, kind string) (*mpdAdaptationSet, *mpdRepresentation) {
+	var bestSet *mpdAdaptationSet
+	var best *mpdRepresentation
+	for i := range p.AdaptationSets {
+		as := &p.AdaptationSets[i]
+		if as.kind() != kind {
+			continue
+		}
+		for j := range as.Representations {
+			rep := &as.Representations[j]
+			if kind == "video" && (rep.Bandwidth < d.MinBandwidth || (d.MaxBandwidth != 0 && rep.Bandwidth > d.MaxBandwidth)) {
+				continue
+			}
+			if best == nil || rep.Bandwidth > best.Bandwidth {
+				bestSet, best = as, rep
+			}
+		}
+	}
+	return bestSet, best
+}
+
+func (d *Downloader) fetchMPD(ctx context.Context, mpdURL string) (*mpd, error) {
+	req, err := d.newRequest(ctx, "GET", mpdURL, playlistRequest)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, playlistStatusError(resp.StatusCode, mpdURL, false)
+	}
+	var m mpd
+	if err := xml.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%w: %v: %v", ErrPlaylistDecode, mpdURL, err)
+	}
+	return &m, nil
+}
+
+// dashSegments lists the segments of the selected representation of the
+// given kind, across all periods of a static MPD or in the last period of a
+// live one.
+func (d *Downloader) dashSegments(m *mpd, mpdURL *url.URL, kind string) ([]dashSegment, error) {
+	live := m.Type == "dynamic"
+	total, _ := parseISODuration(m.MediaPresentationDuration)
+	var elapsed time.Duration
+	if live {
+		ast, err := time.Parse(time.RFC3339, m.AvailabilityStartTime)
+		if err != nil {
+			return nil, fmt.Errorf("%w: live MPD without a valid availabilityStartTime", ErrPlaylistDecode)
+		}
+		elapsed = time.Now().Sub(ast)
+	}
+
+	periods := m.Periods
+	if live && len(periods) > 1 {
+		periods = periods[len(periods)-1:]
+	}
+	var segs []dashSegment
+	for i := range periods {
+		p := &periods[i]
+		as, rep := d.selectRepresentation(p, kind)
+		if rep == nil {
+			continue
+		}
+		base, err := resolveBase(mpdURL, m.BaseURL, p.BaseURL, as.BaseURL, rep.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		tpl := rep.SegmentTemplate
+		if tpl == nil {
+			tpl = as.SegmentTemplate
+		}
+		if tpl == nil {
+			// The representation is a single file.
+			segs = append(segs, dashSegment{URI: base.String(), duration: total})
+			continue
+		}
+		start, _ := parseISODuration(p.Start)
+		duration, _ := parseISODuration(p.Duration)
+		if duration == 0 && i+1 < len(periods) {
+			// A period lasts until the next one starts.
+			if next, _ := parseISODuration(periods[i+1].Start); next > start {
+				duration = next - start
+			}
+		}
+		if duration == 0 && total > 0 {
+			duration = total - start
+		}
+		periodSegs, err := tpl.segments(base, rep, duration, live, elapsed-start)
+		if err != nil {
+			return nil, err
+		}
+		segs = append(segs, periodSegs...)
+	}
+	return segs, nil
+}
+
+// getDASH is the DASH counterpart of getPlaylist: it queues the segments of
+// the selected representation of one kind, re-reading live manifests.
+func (d *Downloader) getDASH(ctx context.Context, urlStr, kind string, dlc chan *segment) {
+	defer close(dlc)
+	mpdURL, err := url.Parse(urlStr)
+	if err != nil {
+		d.fail(err)
+		return
+	}
+	cache := lru.New(4096)
+	var prog *progress
+	var recDuration time.Duration
+	for ctx.Err() == nil {
+		m, err := d.fetchMPD(ctx, urlStr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			d.fail(err)
+			return
+		}
+		segs, err := d.dashSegments(m, mpdURL, kind)
+		if err != nil {
+			d.fail(err)
+			return
+		}
+		live := m.Type == "dynamic"
+		if !live && prog == nil {
+			var durations []time.Duration
+			for _, s := range segs {
+				if s.duration > 0 {
+					durations = append(durations, s.duration)
+				}
+			}
+			prog = newProgress(durations)
+		}
+		for _, s := range segs {
+			if _, hit := cache.Get(s.URI); hit {
+				continue
+			}
+			cache.Add(s.URI, nil)
+			recDuration += s.duration
+			v := &segment{
+				URI:           s.URI,
+				totalDuration: recDuration,
+				duration:      s.duration,
+				seqNo:         s.number,
+			}
+			if s.duration > 0 {
+				// Initialization segments do not count towards progress.
+				v.progress = prog
+			}
+			if !send(ctx, dlc, v) {
+				return
+			}
+			if d.Duration != 0 && recDuration >= d.Duration {
+				log.Printf("Recorded %v of %v. Stopping.\n", recDuration, d.Duration)
+				return
+			}
+		}
+		if !live {
+			return
+		}
+
+		wait, err := parseISODuration(m.MinimumUpdatePeriod)
+		if err != nil || wait <= 0 {
+			wait = 2 * time.Second
+		}
+		if d.Refresh > 0 {
+			wait = d.Refresh
+		}
+		sleep(ctx, wait)
+	}
+}
+
+// recordDASH records the best video representation of an MPD to fn and,
+// since DASH keeps them apart, the best audio representation next to it.
+func (d *Downloader) recordDASH(ctx context.Context, mpdURI, fn string) {
+	m, err := d.fetchMPD(ctx, mpdURI)
+	if err != nil {
+		d.fail(err)
+		return
+	}
+	if len(m.Periods) == 0 {
+		d.fail(fmt.Errorf("%w: MPD has no periods", ErrPlaylistDecode))
+		return
+	}
+
+	outputs := map[string]string{}
+	p := &m.Periods[len(m.Periods)-1]
+	for _, kind := range []string{"video", "audio"} {
+		_, rep := d.selectRepresentation(p, kind)
+		if rep == nil {
+			continue
+		}
+		log.Printf("Selected %v representation %v with bandwidth %v.\n", kind, rep.ID, rep.Bandwidth)
+		outputs[kind] = fn
+		if kind == "audio" && outputs["video"] != "" {
+			outputs[kind] = variantFileName(fn, "audio")
+		}
+	}
+	if len(outputs) == 0 {
+		d.fail(fmt.Errorf("No video or audio representation with bandwidth between %v and %v", d.MinBandwidth, bandwidthLimit(d.MaxBandwidth)))
+		return
+	}
+
+	var wg sync.WaitGroup
+	for kind, out := range outputs {
+		wg.Add(1)
+		go func(kind, out string) {
+			defer wg.Done()
+			dlc := make(chan *segment, d.QueueSize)
+			go d.getDASH(ctx, mpdURI, kind, dlc)
+			d.downloadSegment(ctx, out, dlc)
+		}(kind, out)
+	}
+	wg.Wait()
+}
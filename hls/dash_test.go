@@ -0,0 +1,65 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "encoding/xml"
+import "errors"
+import "net/url"
+import "strings"
+import "testing"
+
+func TestDASHTemplateDuration(t *testing.T) {
+	period := `<Period %v><AdaptationSet mimeType="video/mp4">
+<SegmentTemplate timescale="1000" duration="4000" media="v$Number$.m4s"/>
+<Representation id="v" bandwidth="1000"/>
+</AdaptationSet></Period>`
+	tests := []struct {
+		name     string
+		mpd      string
+		segments int
+	}{
+		{"presentation duration", `<MPD type="static" mediaPresentationDuration="PT10S">` + period + `</MPD>`, 3},
+		{"period duration", `<MPD type="static">` + strings.Replace(period, "%v", `duration="PT8S"`, 1) + `</MPD>`, 2},
+		{"next period start", `<MPD type="static">` + strings.Replace(period, "%v", `start="PT0S"`, 1) +
+			strings.Replace(period, "%v", `start="PT12S" duration="PT4S"`, 1) + `</MPD>`, 4},
+		{"unknown duration", `<MPD type="static">` + period + `</MPD>`, -1},
+	}
+	d, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse("http://example.com/m.mpd")
+	for _, tt := range tests {
+		var m mpd
+		if err := xml.Unmarshal([]byte(strings.Replace(tt.mpd, "%v", "", -1)), &m); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		segs, err := d.dashSegments(&m, base, "video")
+		if tt.segments < 0 {
+			if !errors.Is(err, ErrPlaylistDecode) {
+				t.Errorf("%v: got %v segments and error %v", tt.name, len(segs), err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		} else if len(segs) != tt.segments {
+			t.Errorf("%v: got %v segments, want %v", tt.name, len(segs), tt.segments)
+		}
+	}
+}
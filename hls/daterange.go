@@ -0,0 +1,225 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bufio"
+import "bytes"
+import "fmt"
+import "log"
+import "os"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// dateRange is an EXT-X-DATERANGE of a media playlist, which live streams
+// use to mark ad breaks with SCTE-35 data.
+type dateRange struct {
+	id       string
+	class    string
+	start    time.Time
+	duration time.Duration // 0 until known
+	planned  time.Duration // PLANNED-DURATION
+	ad       bool          // carries SCTE35-OUT or SCTE35-CMD
+	logged   bool
+}
+
+// end returns the end of the range, or the zero time if it is not known.
+func (r *dateRange) end() time.Time {
+	switch {
+	case r.duration > 0:
+		return r.start.Add(r.duration)
+	case r.planned > 0:
+		return r.start.Add(r.planned)
+	}
+	return time.Time{}
+}
+
+// parseDateRanges returns the EXT-X-DATERANGE tags in a media playlist. The
+// playlist parser drops them, so they are read from the raw text.
+func parseDateRanges(playlist []byte) []*dateRange {
+	var ranges []*dateRange
+	s := bufio.NewScanner(bytes.NewReader(playlist))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if !strings.HasPrefix(line, "#EXT-X-DATERANGE:") {
+			continue
+		}
+		attrs := parseAttributes(strings.TrimPrefix(line, "#EXT-X-DATERANGE:"))
+		r := &dateRange{id: attrs["ID"], class: attrs["CLASS"]}
+		var err error
+		if r.start, err = time.Parse(time.RFC3339Nano, attrs["START-DATE"]); err != nil || r.id == "" {
+			log.Printf("Ignoring invalid %v\n", line)
+			continue
+		}
+		r.duration = parseSeconds(attrs["DURATION"])
+		r.planned = parseSeconds(attrs["PLANNED-DURATION"])
+		if end, err := time.Parse(time.RFC3339Nano, attrs["END-DATE"]); err == nil && r.duration == 0 {
+			r.duration = end.Sub(r.start)
+		}
+		_, out := attrs["SCTE35-OUT"]
+		_, cmd := attrs["SCTE35-CMD"]
+		r.ad = out || cmd
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// parseAttributes splits an attribute list like ID="ad1",DURATION=30.0 into
+// its names and values, without the quotes.
+func parseAttributes(list string) map[string]string {
+	attrs := map[string]string{}
+	for list != "" {
+		eq := strings.IndexByte(list, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(list[:eq])
+		list = list[eq+1:]
+		var value string
+		if strings.HasPrefix(list, `"`) {
+			end := strings.IndexByte(list[1:], '"')
+			if end < 0 {
+				value, list = list[1:], ""
+			} else {
+				value, list = list[1:end+1], list[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(list, ',')
+			if end < 0 {
+				end = len(list)
+			}
+			value = list[:end]
+			list = list[end:]
+		}
+		list = strings.TrimPrefix(list, ",")
+		attrs[name] = value
+	}
+	return attrs
+}
+
+func parseSeconds(s string) time.Duration {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0
+	}
+	return time.Duration(f * float64(time.Second))
+}
+
+// markers collects the date ranges seen during a download, across reloads
+// and variants, and writes them to the -ad-markers file at the end.
+type markers struct {
+	mu     sync.Mutex
+	ranges map[string]*dateRange
+	first  time.Time // program date-time of the first recorded segment
+}
+
+func newMarkers() *markers {
+	return &markers{ranges: map[string]*dateRange{}}
+}
+
+// update adds the date ranges of a playlist reload and logs new ones. A
+// range may be given again with its duration once the ad break ends.
+func (m *markers) update(ranges []*dateRange) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range ranges {
+		known, ok := m.ranges[r.id]
+		if !ok {
+			m.ranges[r.id] = r
+			known = r
+		} else if known.duration == 0 && r.duration > 0 {
+			known.duration = r.duration
+			known.logged = false
+		}
+		known.ad = known.ad || r.ad
+		if known.logged {
+			continue
+		}
+		known.logged = true
+		kind := "Date range"
+		if known.ad {
+			kind = "Ad break"
+		}
+		if known.duration > 0 {
+			log.Printf("%v %v at %v for %v.\n", kind, known.id, known.start.Format(time.RFC3339), known.duration)
+		} else if known.planned > 0 {
+			log.Printf("%v %v at %v, planned for %v.\n", kind, known.id, known.start.Format(time.RFC3339), known.planned)
+		} else {
+			log.Printf("%v %v at %v.\n", kind, known.id, known.start.Format(time.RFC3339))
+		}
+	}
+}
+
+// recorded notes the program date-time of a segment going to the output,
+// which the offsets in the -ad-markers file are relative to.
+func (m *markers) recorded(pdt time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.first.IsZero() {
+		m.first = pdt
+	}
+}
+
+// inAd tells whether the segment at pdt lies within an ad break of known
+// length.
+func (m *markers) inAd(pdt time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.ranges {
+		if r.ad && !pdt.Before(r.start) && pdt.Before(r.end()) {
+			return true
+		}
+	}
+	return false
+}
+
+// write saves the ranges to fn, one per line in order of their start: the
+// offset from the start of the recording, the duration (0 if unknown), the
+// start date, "ad" or "range", the ID and the class.
+func (m *markers) write(fn string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ranges []*dateRange
+	for _, r := range m.ranges {
+		ranges = append(ranges, r)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Before(ranges[j].start) })
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, r := range ranges {
+		offset := "-"
+		if !m.first.IsZero() {
+			offset = r.start.Sub(m.first).String()
+		}
+		kind := "range"
+		if r.ad {
+			kind = "ad"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", offset, r.duration, r.start.Format(time.RFC3339Nano), kind, r.id, r.class)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
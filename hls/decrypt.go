@@ -0,0 +1,269 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "crypto/aes"
+import "crypto/cipher"
+import "encoding/binary"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "log"
+import "net/url"
+import "strings"
+import "sync"
+import "github.com/kz26/m3u8"
+
+// segmentKey is the EXT-X-KEY in effect for a segment.
+type segmentKey struct {
+	uri string
+	iv  []byte
+	// The key URI without the -key-query token, which changes between
+	// sessions, for looking the key up in the -keystore. Empty if the same.
+	stored string
+}
+
+// newSegmentKey returns the decryption parameters for the segment with media
+// sequence number seq, or nil if it is not encrypted. Without an explicit IV
+// attribute, the IV is the sequence number as a 128-bit big-endian integer.
+// A relative key URI is resolved against playlistURL, the final URL of the
+// playlist after redirects, like segment URIs.
+func (d *Downloader) newSegmentKey(k *m3u8.Key, playlistURL *url.URL, seq uint64) (*segmentKey, error) {
+	if k == nil || k.Method == "" || k.Method == "NONE" {
+		return nil, nil
+	}
+	if k.Method != "AES-128" {
+		return nil, fmt.Errorf("unsupported encryption method %v", k.Method)
+	}
+	keyURL, err := d.keyURL(playlistURL, k.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if k.IV != "" {
+		iv, err = parseIV(k.IV)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		binary.BigEndian.PutUint64(iv[8:], seq)
+	}
+	sk := &segmentKey{uri: keyURL.String(), iv: iv}
+	if stored, _ := playlistURL.Parse(k.URI); stored.String() != sk.uri {
+		sk.stored = stored.String()
+	}
+	return sk, nil
+}
+
+// keyURL resolves a key URI against playlistURL. With -key-query, a key URI
+// without a query of its own gets the query of playlistURL, for CDNs that
+// want the playlist's signing token on key requests too.
+func (d *Downloader) keyURL(playlistURL *url.URL, uri string) (*url.URL, error) {
+	keyURL, err := playlistURL.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if d.KeyQuery && keyURL.RawQuery == "" && !keyURL.ForceQuery {
+		keyURL.RawQuery = playlistURL.RawQuery
+	}
+	return keyURL, nil
+}
+
+func parseIV(s string) ([]byte, error) {
+	h := strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	if len(h) > 2*aes.BlockSize {
+		return nil, fmt.Errorf("IV %v is longer than 128 bits", s)
+	}
+	h = strings.Repeat("0", 2*aes.BlockSize-len(h)) + h
+	iv, err := hex.DecodeString(h)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IV %v", s)
+	}
+	return iv, nil
+}
+
+// keyCache keeps fetched keys by URI, as they are shared by many segments.
+// Segments needing a key that is being fetched wait for it, without holding
+// up those needing other keys.
+type keyCache struct {
+	sync.Mutex
+	keys map[string]*keyFetch
+}
+
+// keyFetch is a key being fetched, or fetched already once done is closed.
+type keyFetch struct {
+	done chan struct{}
+	key  []byte
+	err  error
+}
+
+func (d *Downloader) fetchKey(ctx context.Context, k *segmentKey) ([]byte, error) {
+	d.keys.Lock()
+	f, ok := d.keys.keys[k.uri]
+	if !ok {
+		f = &keyFetch{done: make(chan struct{})}
+		d.keys.keys[k.uri] = f
+	}
+	d.keys.Unlock()
+	if !ok {
+		f.key, f.err = d.loadKey(ctx, k)
+		if f.err != nil {
+			// The next segment tries again.
+			d.keys.Lock()
+			delete(d.keys.keys, k.uri)
+			d.keys.Unlock()
+		}
+		close(f.done)
+	}
+	select {
+	case <-f.done:
+		return f.key, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// loadKey requests a key, falling back to the -keystore, and stores it
+// there.
+func (d *Downloader) loadKey(ctx context.Context, k *segmentKey) ([]byte, error) {
+	uri, stored := k.uri, k.stored
+	if stored == "" {
+		stored = uri
+	}
+	key, err := d.requestKey(ctx, uri)
+	if err != nil && d.keystore != nil {
+		// The key server may be gone by the time a download is resumed.
+		if storedKey, ok := d.keystore.get(stored); ok {
+			log.Printf("Using the stored key for %v. %v\n", stored, err)
+			key, err = storedKey, nil
+		}
+	} else if err == nil && d.keystore != nil {
+		if err := d.keystore.add(stored, key); err != nil {
+			log.Printf("Could not store key %v. %v\n", stored, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (d *Downloader) requestKey(ctx context.Context, uri string) ([]byte, error) {
+	req, err := d.newRequest(ctx, "GET", uri, keyRequest)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("received HTTP %v for key %v", resp.StatusCode, uri)
+	}
+	key, err := ioutil.ReadAll(io.LimitReader(resp.Body, aes.BlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("key %v is %v bytes, want %v", uri, len(key), aes.BlockSize)
+	}
+	return key, nil
+}
+
+// decryptSegment wraps an AES-128 encrypted segment body in a reader
+// returning the plain text.
+func (d *Downloader) decryptSegment(ctx context.Context, k *segmentKey, body io.Reader) (io.Reader, error) {
+	key, err := d.fetchKey(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cbcReader{src: body, mode: cipher.NewCBCDecrypter(block, k.iv)}, nil
+}
+
+// cbcReader decrypts a CBC stream and strips the PKCS#7 padding. The last
+// full block is held back until EOF since it carries the padding.
+type cbcReader struct {
+	src     io.Reader
+	mode    cipher.BlockMode
+	pending []byte // cipher text not yet decrypted
+	plain   []byte // decrypted, not yet read
+	chunk   []byte // read buffer
+	eof     bool
+}
+
+func (c *cbcReader) Read(p []byte) (int, error) {
+	if c.chunk == nil {
+		c.chunk = make([]byte, 32*1024)
+	}
+	for len(c.plain) == 0 && !c.eof {
+		n, err := c.src.Read(c.chunk)
+		c.pending = append(c.pending, c.chunk[:n]...)
+		if err == io.EOF {
+			if len(c.pending)%aes.BlockSize != 0 {
+				return 0, errors.New("encrypted segment is not a multiple of the block size")
+			}
+			c.decrypt(len(c.pending))
+			if err := c.unpad(); err != nil {
+				return 0, err
+			}
+			c.eof = true
+		} else if err != nil {
+			return 0, err
+		} else if blocks := len(c.pending)/aes.BlockSize - 1; blocks > 0 {
+			c.decrypt(blocks * aes.BlockSize)
+		}
+	}
+
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	if n == 0 && c.eof {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (c *cbcReader) decrypt(n int) {
+	if n == 0 {
+		return
+	}
+	out := make([]byte, n)
+	c.mode.CryptBlocks(out, c.pending[:n])
+	c.plain = append(c.plain, out...)
+	c.pending = c.pending[n:]
+}
+
+func (c *cbcReader) unpad() error {
+	if len(c.plain) == 0 {
+		return nil
+	}
+	pad := int(c.plain[len(c.plain)-1])
+	if pad == 0 || pad > aes.BlockSize || pad > len(c.plain) {
+		return errors.New("invalid padding in decrypted segment")
+	}
+	c.plain = c.plain[:len(c.plain)-pad]
+	return nil
+}
@@ -0,0 +1,286 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bytes"
+import "context"
+import "crypto/aes"
+import "crypto/cipher"
+import "encoding/binary"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "net/url"
+import "net/http/httptest"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "testing/iotest"
+import "time"
+
+var testKey = []byte("0123456789abcdef")
+
+// encrypt encrypts plain with AES-128-CBC and PKCS#7 padding, as segments are.
+func encrypt(key, iv, plain []byte) string {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	n := aes.BlockSize - len(plain)%aes.BlockSize
+	padded := append(append([]byte{}, plain...), bytes.Repeat([]byte{byte(n)}, n)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	return string(padded)
+}
+
+// sequenceIV is the IV of a segment without an explicit one.
+func sequenceIV(seq uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], seq)
+	return iv
+}
+
+func TestParseIV(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []byte
+		ok   bool
+	}{
+		{"0x000102030405060708090a0b0c0d0e0f", []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, true},
+		{"0X000102030405060708090A0B0C0D0E0F", []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, true},
+		// Short IVs are zero padded on the left.
+		{"0x2a", sequenceIV(42), true},
+		{"0x000102030405060708090a0b0c0d0e0f10", nil, false},
+		{"0xzz", nil, false},
+	}
+	for _, tt := range tests {
+		iv, err := parseIV(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseIV(%q) error = %v", tt.s, err)
+			continue
+		}
+		if !bytes.Equal(iv, tt.want) {
+			t.Errorf("parseIV(%q) = %x, want %x", tt.s, iv, tt.want)
+		}
+	}
+}
+
+func TestCBCReader(t *testing.T) {
+	iv := sequenceIV(3)
+	block, _ := aes.NewCipher(testKey)
+	for _, size := range []int{0, 1, 15, 16, 17, 32, 100000} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i)
+		}
+		r := &cbcReader{
+			src:  iotest.HalfReader(strings.NewReader(encrypt(testKey, iv, plain))),
+			mode: cipher.NewCBCDecrypter(block, iv),
+		}
+		got, err := ioutil.ReadAll(iotest.OneByteReader(r))
+		if err != nil {
+			t.Errorf("%v bytes: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%v bytes: decrypted %v bytes that do not match", size, len(got))
+		}
+	}
+
+	r := &cbcReader{src: strings.NewReader("not a whole block"), mode: cipher.NewCBCDecrypter(block, iv)}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("a partial block was accepted")
+	}
+}
+
+func TestKeyURL(t *testing.T) {
+	playlistURL, _ := url.Parse("http://example.com/live/p.m3u8?token=abc")
+	tests := []struct {
+		uri      string
+		keyQuery bool
+		want     string
+	}{
+		{"key.bin", false, "http://example.com/live/key.bin"},
+		{"../keys/key.bin", false, "http://example.com/keys/key.bin"},
+		{"/keys/key.bin", false, "http://example.com/keys/key.bin"},
+		{"https://keys.example.net/key.bin", false, "https://keys.example.net/key.bin"},
+		{"key.bin", true, "http://example.com/live/key.bin?token=abc"},
+		{"https://keys.example.net/key.bin", true, "https://keys.example.net/key.bin?token=abc"},
+		// A key URI with a query of its own keeps it.
+		{"key.bin?id=1", true, "http://example.com/live/key.bin?id=1"},
+	}
+	for _, tt := range tests {
+		d := &Downloader{Options: Options{KeyQuery: tt.keyQuery}}
+		got, err := d.keyURL(playlistURL, tt.uri)
+		if err != nil {
+			t.Errorf("keyURL(%q): %v", tt.uri, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("keyURL(%q) with -key-query=%v = %v, want %v", tt.uri, tt.keyQuery, got, tt.want)
+		}
+	}
+}
+
+func TestKeyQuery(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="%v"
+#EXTINF:4.0,
+0.ts
+#EXT-X-ENDLIST
+`
+	tests := []struct {
+		keyURI   string
+		keyQuery bool
+		ok       bool
+	}{
+		{"key.bin", false, false},
+		{"key.bin", true, true},
+		// Not tokened twice.
+		{"key.bin?token=secret", true, true},
+	}
+	for _, tt := range tests {
+		var keyQueries []string
+		files := serveFiles(map[string]string{
+			"/p.m3u8": fmt.Sprintf(playlist, tt.keyURI),
+			"/0.ts":   encrypt(testKey, sequenceIV(7), []byte("segment")),
+		})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/key.bin" {
+				files(w, r)
+				return
+			}
+			keyQueries = append(keyQueries, r.URL.RawQuery)
+			if r.URL.RawQuery == "token=secret" {
+				w.Write(testKey)
+			} else {
+				http.Error(w, "no token", http.StatusForbidden)
+			}
+		}))
+		data, err := record(t, Options{KeyQuery: tt.keyQuery}, srv.URL+"/p.m3u8?token=secret")
+		srv.Close()
+		if ok := err == nil && string(data) == "segment"; ok != tt.ok {
+			t.Errorf("%v with -key-query=%v: got %q, %v", tt.keyURI, tt.keyQuery, data, err)
+		}
+		if tt.ok && len(keyQueries) != 1 {
+			t.Errorf("%v with -key-query=%v: key requested with %q", tt.keyURI, tt.keyQuery, keyQueries)
+		}
+	}
+}
+
+func TestFetchKey(t *testing.T) {
+	release := make(chan struct{})
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/slow.bin" {
+			<-release
+		}
+		w.Write(testKey)
+	}))
+	defer srv.Close()
+	d, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	fast := &segmentKey{uri: srv.URL + "/fast.bin"}
+	if _, err := d.fetchKey(ctx, fast); err != nil {
+		t.Fatal(err)
+	}
+
+	// Several segments wait for the slow key, which is requested once.
+	slow := &segmentKey{uri: srv.URL + "/slow.bin"}
+	errs := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := d.fetchKey(ctx, slow)
+			errs <- err
+		}()
+	}
+	// Meanwhile the cached key is still handed out.
+	done := make(chan struct{})
+	go func() {
+		d.fetchKey(ctx, fast)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a cached key waited for another key to be fetched")
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("%v key requests, want 2", n)
+	}
+}
+
+func TestDecryptPlaylist(t *testing.T) {
+	explicitIV := []byte("fedcba9876543210")
+	explicit := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x66656463626139383736353433323130
+#EXTINF:4.0,
+0.ts
+#EXTINF:4.0,
+1.ts
+#EXT-X-ENDLIST
+`
+	derived := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXTINF:4.0,
+0.ts
+#EXTINF:4.0,
+1.ts
+#EXT-X-ENDLIST
+`
+	tests := []struct {
+		name     string
+		playlist string
+		ivs      [2][]byte
+	}{
+		{"explicit IV", explicit, [2][]byte{explicitIV, explicitIV}},
+		{"derived IV", derived, [2][]byte{sequenceIV(7), sequenceIV(8)}},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(serveFiles(map[string]string{
+			"/p.m3u8":  tt.playlist,
+			"/key.bin": string(testKey),
+			"/0.ts":    encrypt(testKey, tt.ivs[0], []byte("first segment")),
+			"/1.ts":    encrypt(testKey, tt.ivs[1], []byte("second segment")),
+		}))
+		data, err := record(t, Options{}, srv.URL+"/p.m3u8")
+		srv.Close()
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if want := "first segmentsecond segment"; string(data) != want {
+			t.Errorf("%v: got %q, want %q", tt.name, data, want)
+		}
+	}
+}
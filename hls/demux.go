@@ -0,0 +1,129 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "fmt"
+import "log"
+import "os"
+
+var streamExtensions = map[byte]string{
+	streamTypeMPEG1Audio: "mp3",
+	streamTypeMPEG2Audio: "mp3",
+	streamTypeAAC:        "aac",
+	streamTypeH264:       "h264",
+	streamTypeH265:       "h265",
+}
+
+// tsDemuxer writes the elementary streams of the MPEG-TS written to it into
+// separate files named after base, e.g. out.ts.h264 and out.ts.aac.
+type tsDemuxer struct {
+	base    string
+	pmtPIDs map[uint16]bool
+	streams map[uint16]byte
+	files   map[uint16]*os.File
+	used    map[string]bool
+	tsPacketizer
+}
+
+func newTSDemuxer(base string) *tsDemuxer {
+	d := &tsDemuxer{
+		base:    base,
+		pmtPIDs: map[uint16]bool{},
+		streams: map[uint16]byte{},
+		files:   map[uint16]*os.File{},
+		used:    map[string]bool{},
+	}
+	d.handle = d.packet
+	return d
+}
+
+func (d *tsDemuxer) packet(p tsPacket) error {
+	pid := p.pid()
+	switch {
+	case pid == patPID:
+		if p.unitStart() {
+			for _, pmt := range parsePAT(psiSection(p.payload())) {
+				d.pmtPIDs[pmt] = true
+			}
+		}
+	case d.pmtPIDs[pid]:
+		if p.unitStart() {
+			for _, s := range parsePMT(psiSection(p.payload())) {
+				d.streams[s.pid] = s.streamType
+			}
+		}
+	default:
+		streamType, ok := d.streams[pid]
+		if !ok {
+			return nil
+		}
+		payload := p.payload()
+		if p.unitStart() {
+			payload = pesPayload(payload)
+		}
+		if len(payload) == 0 {
+			return nil
+		}
+		out, err := d.file(pid, streamType)
+		if out == nil || err != nil {
+			return err
+		}
+		_, err = out.Write(payload)
+		return err
+	}
+	return nil
+}
+
+// file returns the output for pid, creating it on first use. Stream types
+// without a known raw format are skipped.
+func (d *tsDemuxer) file(pid uint16, streamType byte) (*os.File, error) {
+	if f, ok := d.files[pid]; ok {
+		return f, nil
+	}
+	ext, ok := streamExtensions[streamType]
+	if !ok {
+		log.Printf("Not demuxing PID %v with stream type 0x%02x.\n", pid, streamType)
+		d.files[pid] = nil
+		return nil, nil
+	}
+	fn := fmt.Sprintf("%v.%v", d.base, ext)
+	if d.used[fn] {
+		fn = fmt.Sprintf("%v.%v.%v", d.base, pid, ext)
+	}
+	d.used[fn] = true
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Demuxing PID %v to %v.\n", pid, fn)
+	d.files[pid] = f
+	return f, nil
+}
+
+func (d *tsDemuxer) Close() error {
+	var err error
+	for _, f := range d.files {
+		if f == nil {
+			continue
+		}
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
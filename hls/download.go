@@ -0,0 +1,1335 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bytes"
+import "context"
+import "crypto/sha256"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptrace"
+import "net/url"
+import "log"
+import "os"
+import "sort"
+import "strconv"
+import "sync"
+import "sync/atomic"
+import "time"
+import "github.com/golang/groupcache/lru"
+import "strings"
+import "github.com/kz26/m3u8"
+
+// DefaultPlaylistAccept asks for HLS playlists and DASH manifests, but takes
+// anything, as the URL may also be a stream.
+const DefaultPlaylistAccept = "application/vnd.apple.mpegurl, application/x-mpegurl, application/dash+xml;q=0.9, */*;q=0.8"
+
+// requestKind tells what a request fetches, for the User-Agent to send.
+type requestKind int
+
+const (
+	playlistRequest requestKind = iota
+	segmentRequest
+	keyRequest
+)
+
+// newRequest creates a request with the User-Agent for its kind, if one was
+// given. doRequest falls back to the general User-Agent.
+func (d *Downloader) newRequest(ctx context.Context, method, uri string, kind requestKind) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(withRequestKind(ctx, kind), method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	var ua string
+	switch kind {
+	case playlistRequest:
+		ua = d.PlaylistUserAgent
+		req.Header.Set("Accept", d.PlaylistAccept)
+	case segmentRequest:
+		ua = d.SegmentUserAgent
+	case keyRequest:
+		ua = d.KeyUserAgent
+	}
+	if ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
+	return req, nil
+}
+
+func (d *Downloader) doRequest(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", d.UserAgent)
+	}
+	d.setBasicAuth(req)
+	if d.tokens == nil {
+		return d.roundTrip(req)
+	}
+
+	token, generation, err := d.tokens.get()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization(token))
+	resp, err := d.roundTrip(req)
+	if err != nil || !authFailed(resp) {
+		return resp, err
+	}
+
+	// The token may have expired; retry once with a fresh one.
+	resp.Body.Close()
+	log.Printf("Received HTTP %v for %v. Refreshing access token.\n", resp.StatusCode, req.URL)
+	token, err = d.tokens.refresh(generation)
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	retry.Header.Set("Authorization", authorization(token))
+	return d.roundTrip(retry)
+}
+
+// playlistStatusError describes a playlist request that failed for good. A
+// playlist disappearing after recording started means the stream ended.
+func playlistStatusError(code int, urlStr string, started bool) error {
+	kind := ErrHTTP
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		kind = ErrAuth
+	case (code == http.StatusNotFound || code == http.StatusGone) && started:
+		kind = ErrStreamEnded
+	}
+	return fmt.Errorf("%w: received HTTP %v for %v", kind, code, urlStr)
+}
+
+// retryableStatus reports whether an HTTP status is worth retrying later.
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// nextBackoff doubles the previous wait, starting at one second and going up
+// to max. A Retry-After header given in seconds takes precedence.
+func nextBackoff(prev, max time.Duration, resp *http.Response) time.Duration {
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	next := 2 * prev
+	if next == 0 {
+		next = time.Second
+	}
+	if next > max {
+		next = max
+	}
+	return next
+}
+
+// sleep waits for d, returning false early if ctx is done.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// segment stores URI/duration to process
+type segment struct {
+	URI           string
+	totalDuration time.Duration
+	duration      time.Duration
+	progress      *progress
+
+	seqNo           uint64
+	programDateTime time.Time
+	key             *segmentKey
+	offset          int64 // bytes of the segment already in the output
+	discontinuity   bool
+	rangeStart      int64  // EXT-X-BYTERANGE sub-range of the resource
+	rangeLength     int64  // 0 == the whole resource
+	checksum        []byte // SHA-256 of the downloaded segment for -checksum-manifest
+	expected        []byte // SHA-256 the manifest gives for Replay
+	size            int64
+	elapsed         time.Duration // time the download took
+	deadline        time.Time     // when a live segment leaves the playlist, for -live-deadline
+	init            *segment      // EXT-X-MAP initialization section, for fragmented MP4
+	data            *bytes.Buffer // set when prefetched by a worker
+	fetched         bool
+
+	// split starts a new output file with this segment.
+	split bool
+}
+
+type stream struct {
+	URI       string
+	localFile string
+}
+
+// send queues v for download, returning false if ctx is done first.
+func send(ctx context.Context, dlc chan *segment, v *segment) bool {
+	select {
+	case dlc <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (d *Downloader) downloadSegment(ctx context.Context, fn string, dlc chan *segment) {
+	out, err := d.openOutput(ctx, fn)
+	if err != nil {
+		d.fail(err)
+		return
+	}
+	defer func() { out.Close() }()
+	part := 0
+	partStart := atomic.LoadInt64(&d.written)
+
+	if d.Trace {
+		defer func() { log.Print(&d.timings) }()
+	}
+
+	if d.Concurrency > 1 || d.AutoConcurrency {
+		dlc = d.prefetchSegments(ctx, dlc)
+	}
+
+	preallocated := false
+	var lastHash [sha256.Size]byte
+	// The initialization section last written to the output. A resumed
+	// output has the one of the first segment already.
+	lastInit := ""
+	resumed := d.resumeFrom > 0
+	for v := range dlc {
+		if ctx.Err() != nil {
+			return
+		}
+		if d.SplitSize > 0 && atomic.LoadInt64(&d.written)-partStart >= int64(d.SplitSize) {
+			// Segments are never cut, so every part plays on its own.
+			v.split = true
+		}
+		if v.split {
+			out.Close()
+			partStart = atomic.LoadInt64(&d.written)
+			part++
+			out, err = d.openOutput(ctx, partName(fn, part))
+			if err != nil {
+				d.fail(err)
+				return
+			}
+			log.Printf("Continuing in %v.\n", out.name)
+			lastInit = ""
+		}
+
+		out.startSegment(v)
+		if v.init != nil && v.init.initKey() != lastInit {
+			lastInit = v.init.initKey()
+			if !resumed && !d.writeInit(ctx, v, out) {
+				d.fail(fmt.Errorf("Could not download the initialization section %v.", v.init.URI))
+				return
+			}
+		}
+		resumed = false
+		var dst io.Writer = out.w
+		var segFile *os.File
+		if d.SegmentsDir != "" {
+			segFile, err = d.createSegmentFile(v)
+			if err != nil {
+				d.fail(err)
+				return
+			}
+			dst = io.MultiWriter(out.w, segFile)
+		}
+		duplicate := false
+		var ok bool
+		if d.DedupContent {
+			// Hashing needs the whole segment before any of it is written.
+			var buf bytes.Buffer
+			if ok = d.fetchSegment(ctx, v, &buf); ok {
+				sum := sha256.Sum256(buf.Bytes())
+				if sum == lastHash {
+					log.Printf("%v is identical to the previous segment. Skipping it.\n", v.URI)
+					duplicate = true
+				} else if _, err := dst.Write(buf.Bytes()); err != nil {
+					d.writeFailed(err)
+				}
+				lastHash = sum
+			}
+		} else {
+			ok = d.fetchSegment(ctx, v, dst)
+		}
+		if d.report != nil {
+			d.report.add(v, ok, duplicate)
+		}
+		if segFile != nil {
+			segFile.Close()
+			if duplicate {
+				os.Remove(segFile.Name())
+			}
+		}
+		if err := out.endSegment(v); err != nil {
+			d.writeFailed(err)
+		}
+
+		// Only VOD downloads know their total duration, and the first
+		// segment gives the bitrate to estimate the size from.
+		if d.Preallocate && !preallocated && out.file != nil && v.progress != nil && v.progress.finished() > 0 {
+			preallocated = true
+			preallocateOutput(out.file, v.progress.estimatedSize())
+		}
+	}
+}
+
+// initKey tells initialization sections apart, including sub-ranges of the
+// same resource.
+func (v *segment) initKey() string {
+	return fmt.Sprintf("%v@%v+%v", v.URI, v.rangeStart, v.rangeLength)
+}
+
+// writeInit writes the initialization section of v to out, for fragmented
+// MP4 segments that cannot be played without it.
+func (d *Downloader) writeInit(ctx context.Context, v *segment, out *output) bool {
+	section := *v.init
+	section.totalDuration = v.totalDuration - v.duration
+	if !d.onDownload(ctx, &section, out.w) {
+		return false
+	}
+	if err := out.addToManifest(&section, true); err != nil {
+		d.writeFailed(err)
+	}
+	return true
+}
+
+// segmentBuffers holds the buffers segments are downloaded into, instead of
+// allocating a new one for every segment.
+var segmentBuffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// maxPooledBuffer is the largest buffer kept in segmentBuffers, so one huge
+// segment does not hold on to its memory for the rest of the download.
+const maxPooledBuffer = 4 << 20
+
+// putSegmentBuffer returns buf to segmentBuffers unless it grew too large.
+func putSegmentBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		segmentBuffers.Put(buf)
+	}
+}
+
+// onDownload fetches a segment into out, reporting whether it succeeded.
+func (d *Downloader) onDownload(ctx context.Context, v *segment, out io.Writer) bool {
+	buf, ok := d.fetchData(ctx, v)
+	defer putSegmentBuffer(buf)
+	if !ok {
+		return false
+	}
+	if _, err := buf.WriteTo(out); err != nil {
+		d.writeFailed(err)
+		return false
+	}
+	return true
+}
+
+// fetchData downloads a segment into a buffer from the pool, retrying up to
+// -retries times after transient failures. Nothing reaches the output until
+// the whole segment is in, so a retry never writes part of it twice.
+func (d *Downloader) fetchData(ctx context.Context, v *segment) (*bytes.Buffer, bool) {
+	buf := segmentBuffers.Get().(*bytes.Buffer)
+	var backoff time.Duration
+	for attempt := 0; ; attempt++ {
+		buf.Reset()
+		ok, retry := d.fetchAttempt(ctx, v, buf)
+		if ok {
+			return buf, true
+		}
+		if !retry || attempt >= d.Retries || ctx.Err() != nil {
+			return buf, false
+		}
+		backoff = nextBackoff(backoff, d.MaxBackoff, nil)
+		if !v.deadline.IsZero() && time.Now().Add(backoff).After(v.deadline) {
+			log.Printf("Dropping %v: it leaves the live window before it could be retried.\n", v.URI)
+			return buf, false
+		}
+		log.Printf("Retrying %v in %v (%v of %v).\n", v.URI, backoff, attempt+1, d.Retries)
+		if !sleep(ctx, backoff) {
+			return buf, false
+		}
+	}
+}
+
+// -retry-if-body-matches looks at this many bytes at the start of a segment.
+const bodyMatchBytes = 1024
+
+// fetchAttempt makes one attempt at downloading a segment into buf. retry
+// reports whether a failure is worth another attempt.
+func (d *Downloader) fetchAttempt(ctx context.Context, v *segment, buf *bytes.Buffer) (ok, retry bool) {
+	if !d.acquireSlot(ctx) {
+		return false, false
+	}
+	defer d.releaseSlot()
+	start := time.Now()
+	ctx = httptrace.WithClientTrace(ctx, d.conns.clientTrace())
+	var timing *segmentTiming
+	if d.Trace {
+		timing = newSegmentTiming()
+		ctx = httptrace.WithClientTrace(ctx, timing.clientTrace())
+	}
+	req, err := d.newRequest(ctx, "GET", v.URI, segmentRequest)
+	if err != nil {
+		d.fail(err)
+		return false, false
+	}
+	// Encrypted segments can only be decrypted from the start, so the part
+	// already in the output is dropped after decrypting them.
+	skip := v.offset
+	from := v.rangeStart
+	if v.key == nil {
+		from += v.offset
+		skip = 0
+	}
+	ranged := from > 0 || v.rangeLength > 0
+	if v.rangeLength > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", from, v.rangeStart+v.rangeLength-1))
+	} else if ranged {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", from))
+	}
+	d.noCompression(req)
+	var resp *http.Response
+	if d.SegmentConnections > 1 && !ranged {
+		resp, err = d.doRangedRequest(req)
+	} else {
+		resp, err = d.doRequest(req)
+	}
+	if err != nil {
+		log.Print(err)
+		return false, !errors.Is(err, ErrAuth)
+	}
+	defer resp.Body.Close()
+	defer d.conns.done(resp.Close)
+	if resp.StatusCode != 200 && !(ranged && resp.StatusCode == http.StatusPartialContent) {
+		log.Printf("Received HTTP %v for %v\n", resp.StatusCode, v.URI)
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+			d.segmentGone()
+		}
+		return false, retryableStatus(resp.StatusCode)
+	}
+	partial := resp.StatusCode == http.StatusPartialContent
+	maxSize := d.MaxSegmentSize
+	if maxSize > 0 && (partial || v.rangeLength == 0) && resp.ContentLength > int64(maxSize) {
+		log.Printf("Rejecting %v: %v bytes is over the maximum segment size of %v.\n",
+			v.URI, resp.ContentLength, &maxSize)
+		return false, false
+	}
+	var body io.Reader = resp.Body
+	if !partial {
+		// The server sent the whole resource. Cut out the sub-range.
+		skip = v.offset
+		if _, err := io.CopyN(ioutil.Discard, body, v.rangeStart); err != nil {
+			log.Printf("Could not read %v. %v\n", v.URI, err)
+			return false, true
+		}
+		if v.rangeLength > 0 {
+			body = io.LimitReader(body, v.rangeLength)
+		}
+	}
+	if maxSize > 0 {
+		body = io.LimitReader(body, int64(maxSize)+1)
+	}
+	if v.key != nil {
+		body, err = d.decryptSegment(ctx, v.key, body)
+		if err != nil {
+			log.Printf("Could not decrypt %v. %v\n", v.URI, err)
+			return false, true
+		}
+	}
+	if skip > 0 {
+		// Drop the part that is already in the output.
+		if _, err := io.CopyN(ioutil.Discard, body, skip); err != nil {
+			log.Printf("Could not resume %v. %v\n", v.URI, err)
+			return false, true
+		}
+	}
+	written, err := buf.ReadFrom(body)
+	if ctx.Err() != nil {
+		log.Printf("Stopped downloading %v. %v\n", v.URI, ctx.Err())
+		return false, false
+	}
+	if err != nil {
+		log.Printf("Could not download %v. %v\n", v.URI, err)
+		return false, true
+	}
+	if maxSize > 0 && written > int64(maxSize) {
+		log.Printf("Cut off %v at the maximum segment size of %v.\n", v.URI, &maxSize)
+		return false, false
+	}
+	if written == 0 && skip == 0 {
+		// Likely a CDN hiccup. Appending nothing would leave a silent gap.
+		log.Printf("Received an empty segment for %v.\n", v.URI)
+		return false, true
+	}
+	if d.RetryIfBodyMatches != nil {
+		head := buf.Bytes()
+		if len(head) > bodyMatchBytes {
+			head = head[:bodyMatchBytes]
+		}
+		if d.RetryIfBodyMatches.Match(head) {
+			log.Printf("%v looks like an error page rather than a segment.\n", v.URI)
+			return false, true
+		}
+	}
+	if d.Verifier != nil {
+		if err := d.Verifier.Verify(v.URI, buf.Bytes()); err != nil {
+			log.Printf("%v failed verification. %v\n", v.URI, err)
+			return false, true
+		}
+	}
+	if d.ChecksumManifest || v.expected != nil {
+		sum := sha256.Sum256(buf.Bytes())
+		if v.expected != nil && !bytes.Equal(sum[:], v.expected) {
+			log.Printf("%v does not match the checksum in the manifest. Leaving it out.\n", v.URI)
+			atomic.AddInt64(&d.mismatches, 1)
+			return false, false
+		}
+		v.checksum = sum[:]
+	}
+	v.size = written
+	v.elapsed = time.Now().Sub(start)
+	log.Printf("Downloaded %v. Recorded %v.\n", v.URI, v.totalDuration)
+	if timing != nil {
+		timing.done()
+		d.timings.add(timing)
+	}
+	if v.progress != nil {
+		v.progress.add(v.duration, written, time.Now().Sub(start))
+		log.Print(v.progress)
+	}
+	return true, false
+}
+
+// noCompression keeps the transport from asking for gzip on a media request.
+// Media is compressed already, so it would only cost CPU on both ends.
+func (d *Downloader) noCompression(req *http.Request) {
+	if !d.SegmentCompression {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+}
+
+// downloadURI appends the stream to out. It returns true when a resumed
+// download turns out to be complete already.
+func (d *Downloader) downloadURI(ctx context.Context, v *stream, out io.Writer) bool {
+	req, err := d.newRequest(ctx, "GET", v.URI, segmentRequest)
+	if err != nil {
+		d.fail(err)
+		return true
+	}
+	var offset int64
+	file := localFile(out)
+	if d.Resume && file != nil {
+		if info, err := file.Stat(); err == nil && info.Size() > 0 && d.acceptsRanges(ctx, v.URI) {
+			offset = info.Size()
+			req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+		}
+	}
+	d.noCompression(req)
+	resp, err := d.doRequest(req)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		log.Printf("%v is already complete.\n", v.localFile)
+		return true
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		log.Printf("Resuming %v at %v kb.\n", v.localFile, offset/1000)
+	case resp.StatusCode == 200:
+		if offset > 0 {
+			log.Printf("Server ignored the range request. Restarting %v.\n", v.localFile)
+			if err := file.Truncate(0); err != nil {
+				d.fail(err)
+				return true
+			}
+		}
+	default:
+		log.Printf("Received HTTP %v for %v.\n", resp.StatusCode, v.URI)
+		return false
+	}
+	log.Printf("Downloading %v to %v.\n", v.URI, v.localFile)
+	written, err := io.Copy(&countingWriter{out, &d.written}, resp.Body)
+	if err != nil && ctx.Err() == nil {
+		d.writeFailed(err)
+	}
+
+	log.Printf("Downloaded %v kb from %v.\n", written/1000, v.URI)
+	// A response of known length is a file rather than a live stream, so
+	// there is nothing to reconnect for.
+	return err == nil && resp.ContentLength >= 0 && written == resp.ContentLength
+}
+
+// downloadStream records s if it is a direct audio stream. It returns false
+// when the URL is not a stream, so it can be handled as a playlist instead.
+func (d *Downloader) downloadStream(ctx context.Context, s *stream) bool {
+	var out io.WriteCloser
+	defer func() {
+		if out != nil {
+			out.Close()
+		}
+	}()
+
+	shouldWait := false
+	shortSleepInterval := time.Duration(1) * time.Second
+	longSleepInterval := time.Duration(10) * time.Second
+
+	shortTicks := 0
+	longTicks := 0
+
+	maxTicks := 30
+
+	for ctx.Err() == nil {
+		req, err := d.newRequest(ctx, "GET", s.URI, playlistRequest)
+		if err != nil {
+			d.fail(err)
+			return true
+		}
+		resp, err := d.doRequest(req)
+		isStream := false
+		if err == nil {
+			isStream = isStreamResponse(resp)
+			resp.Body.Close()
+		}
+
+		// If provided url is already a stream, just save it
+		if isStream {
+			if out == nil {
+				if d.autoExt {
+					s.localFile = withExtension(s.localFile, extensionForType(resp.Header.Get("Content-Type")))
+				}
+				out, err = d.openSink(ctx, s.localFile)
+				if err != nil {
+					d.fail(err)
+					return true
+				}
+			}
+			shouldWait = true
+			shortTicks = 0
+			longTicks = 0
+			if d.downloadURI(ctx, s, out) {
+				break
+			}
+		} else {
+
+			sleepInterval := longSleepInterval
+			if shortTicks < maxTicks {
+				shortTicks = shortTicks + 1
+				sleepInterval = shortSleepInterval
+			} else if longTicks < maxTicks {
+				longTicks = longTicks + 1
+			} else {
+				break // Break after longTicks > maxTicks
+			}
+
+			if shouldWait {
+				log.Printf("Sleeping for %v.", sleepInterval)
+			} else {
+				log.Print("URL not a stream. Trying it as a playlist.")
+				return false
+			}
+			sleep(ctx, sleepInterval)
+		}
+	}
+	return true
+}
+
+func downloadInProgress(fn string) bool {
+	inProgress := false
+
+	info, err := os.Stat(fn)
+	if os.IsNotExist(err) {
+		return inProgress
+	}
+	if err != nil {
+		log.Printf("Could not get stats for %v. %v", fn, err)
+		return inProgress
+	}
+
+	delta := time.Now().Sub(info.ModTime())
+	justUpdated := delta < time.Duration(5)*time.Minute
+	notEmpty := info.Size() > 0
+	inProgress = justUpdated && notEmpty
+
+	log.Printf("File %v modified %v ago. Size: %v.\n", fn, delta, info.Size())
+
+	return inProgress
+}
+
+func (d *Downloader) getPlaylist(ctx context.Context, urlStr string, dlc chan *segment) {
+	defer close(dlc)
+	startTime := time.Now()
+	var recDuration time.Duration
+	var prog *progress
+	var backoff time.Duration
+	var skipped time.Duration
+	started := false
+	resumeIndex, resumeOffset := -1, int64(0)
+	var masterURL *url.URL
+	var masterFetched time.Time
+	pendingSplit := false
+	var fallback *variantFallback // -follow-variant-on-error
+	cache := lru.New(1024)
+	var lastSeqNo uint64  // media sequence of the previous live reload
+	var lastEnd time.Time // program date-time at the end of the last segment
+	seqReset := false
+	playlistURL, err := url.Parse(urlStr)
+	if err != nil {
+		d.fail(err)
+		return
+	}
+	// fallBack switches to another variant of the master playlist after
+	// the current one failed, reporting whether it did.
+	fallBack := func(reason string) bool {
+		if fallback == nil {
+			return false
+		}
+		next := d.switchVariant(fallback, reason)
+		if next == nil {
+			return false
+		}
+		// Like after -follow-master-refresh, the new variant goes to a
+		// new output file once recording started.
+		playlistURL = next
+		urlStr = next.String()
+		pendingSplit = pendingSplit || started
+		backoff = 0
+		return true
+	}
+	// reconnect starts over from the URL given, master playlist and all,
+	// after the stream was lost, as long as -reconnect allows. The cache
+	// of segments is kept so nothing is recorded twice.
+	firstURL := playlistURL
+	reconnects := 0
+	maxReconnects := d.Reconnect // set by detectMode
+	detected, vod := false, false
+	reconnect := func(err error) bool {
+		if reconnects >= maxReconnects {
+			return false
+		}
+		reconnects++
+		backoff = nextBackoff(backoff, d.MaxBackoff, nil)
+		log.Printf("%v. Reconnecting in %v (%v of %v).\n", err, backoff, reconnects, maxReconnects)
+		sleep(ctx, backoff)
+		playlistURL = firstURL
+		urlStr = firstURL.String()
+		masterURL = nil
+		fallback = nil
+		// Whatever the stream sent meanwhile is missing.
+		seqReset = started
+		return true
+	}
+	for ctx.Err() == nil {
+		if masterURL != nil && d.MasterRefresh > 0 && time.Now().Sub(masterFetched) >= d.MasterRefresh {
+			masterFetched = time.Now()
+			if next := d.refreshVariant(ctx, masterURL, playlistURL); next != nil {
+				// Start a new output file rather than mixing variants.
+				playlistURL = next
+				urlStr = next.String()
+				pendingSplit = true
+			}
+		}
+
+		req, err := d.newRequest(ctx, "GET", urlStr, playlistRequest)
+		if err != nil {
+			d.fail(err)
+			return
+		}
+		resp, err := d.doRequest(req)
+		if errors.Is(err, ErrAuth) {
+			d.fail(err)
+			return
+		}
+		if err != nil {
+			log.Print(err)
+			if fallback != nil && fallback.failed() && fallBack(err.Error()) {
+				continue
+			}
+			sleep(ctx, time.Duration(3)*time.Second)
+			continue
+		}
+
+		// If provided url is already a stream, just save it
+		if isStreamResponse(resp) {
+			resp.Body.Close()
+			recDuration := 12 * time.Hour
+			send(ctx, dlc, &segment{URI: urlStr, totalDuration: recDuration})
+			return
+		}
+
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			if !retryableStatus(resp.StatusCode) {
+				if fallBack(fmt.Sprintf("HTTP %v", resp.StatusCode)) {
+					continue
+				}
+				err := playlistStatusError(resp.StatusCode, urlStr, started)
+				if errors.Is(err, ErrStreamEnded) && reconnect(err) {
+					continue
+				}
+				d.fail(err)
+				return
+			}
+			if fallback != nil && fallback.failed() && fallBack(fmt.Sprintf("HTTP %v", resp.StatusCode)) {
+				continue
+			}
+			backoff = nextBackoff(backoff, d.MaxBackoff, resp)
+			log.Printf("Received HTTP %v for %v. Retrying in %v.\n", resp.StatusCode, urlStr, backoff)
+			sleep(ctx, backoff)
+			continue
+		}
+		backoff = 0
+		if fallback != nil {
+			fallback.errors = 0
+		}
+
+		// EXT-X-DATERANGE is read from the raw playlist.
+		var raw bytes.Buffer
+		playlist, listType, err := d.decodePlaylist(io.TeeReader(resp.Body, &raw), urlStr)
+		if err != nil {
+			resp.Body.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			if started && reconnect(err) {
+				continue
+			}
+			d.fail(err)
+			return
+		}
+		resp.Body.Close()
+		// Segment, key and variant URIs are relative to where the playlist
+		// ended up after redirects. Reloads still go to playlistURL.
+		baseURL := playlistURL
+		if resp.Request != nil {
+			baseURL = resp.Request.URL
+		}
+		if listType == m3u8.MEDIA {
+			mpl := playlist.(*m3u8.MediaPlaylist)
+			if !detected {
+				detected = true
+				maxReconnects, vod = d.detectMode(ctx, mpl)
+			}
+			d.markers.update(parseDateRanges(raw.Bytes()))
+			var cursor playlistCursor
+			if vod && prog == nil {
+				prog = newProgress(segmentDurations(mpl))
+				if d.Precheck {
+					prog.totalBytes = d.precheckSegments(ctx, baseURL, mpl)
+					if ctx.Err() != nil {
+						return
+					}
+				}
+				if d.resumeFrom > 0 {
+					if index, offset, ok := d.resumePoint(ctx, baseURL, mpl, d.resumeFrom); ok {
+						log.Printf("Resuming at segment %v of %v.\n", index+1, prog.total)
+						resumeIndex, resumeOffset = index, offset
+					}
+				}
+			}
+			// Leave the newest segments of a live playlist for a later
+			// reload if they are within -trim-end of the live edge.
+			end := len(mpl.Segments)
+			if !mpl.Closed {
+				end = trimLiveEdge(mpl, d.TrimEnd)
+			}
+			if started && isSequenceReset(mpl, lastSeqNo) {
+				// The encoder restarted and may reuse segment URIs, so forget
+				// what was downloaded rather than skip the new segments.
+				log.Printf("Media sequence went back from %v to %v. Treating it as a restart of the stream.\n", lastSeqNo, mpl.SeqNo)
+				cache = lru.New(1024)
+				seqReset = true
+			}
+			lastSeqNo = mpl.SeqNo
+			filtered := 0
+			for i, v := range mpl.Segments[:end] {
+				if v != nil {
+					seg := cursor.next(v)
+					duration, segPDT := seg.duration, seg.pdt
+					msURI, err := d.segmentURI(baseURL, v.URI)
+					if err != nil {
+						log.Print(err)
+						continue
+					}
+					cacheKey := msURI
+					if v.Limit > 0 {
+						cacheKey = fmt.Sprintf("%v@%v", msURI, seg.rangeStart)
+					}
+					if d.DedupKey == "seq+uri" {
+						cacheKey = fmt.Sprintf("%v %v", mpl.SeqNo+uint64(i), cacheKey)
+					}
+					_, hit := cache.Get(cacheKey)
+					if !hit {
+						cache.Add(cacheKey, nil)
+						if i < resumeIndex {
+							prog.skip(duration)
+							continue
+						}
+
+						// Keep the segments overlapping -range.
+						if vod && (seg.end <= d.RangeStart || d.RangeEnd > 0 && seg.start >= d.RangeEnd) {
+							if prog != nil {
+								prog.skip(duration)
+							}
+							continue
+						}
+						if vod && d.RangeStart > 0 && !started {
+							d.rangeOffset = d.RangeStart - seg.start
+						}
+
+						// The segment is in the cache already, so a filtered
+						// one is not looked at again on the next reload.
+						if !d.wanted(msURI) || d.SkipAds && !segPDT.IsZero() && d.markers.inAd(segPDT) {
+							filtered++
+							if prog != nil {
+								prog.skip(duration)
+							}
+							continue
+						}
+
+						// Drop segments ending before the skip point. The one
+						// spanning it is kept so nothing after it is lost.
+						if skipped < d.Skip {
+							if skipped+duration <= d.Skip {
+								skipped += duration
+								if prog != nil {
+									prog.skip(duration)
+								}
+								continue
+							}
+							log.Printf("Skipped %v.\n", skipped)
+							skipped = d.Skip
+						}
+
+						// Likewise drop segments ending before -since, going
+						// by wall-clock time if the playlist has no dates.
+						if !d.Since.IsZero() && !started {
+							end := time.Now()
+							if !segPDT.IsZero() {
+								end = segPDT.Add(duration)
+							}
+							if !end.After(d.Since) {
+								if prog != nil {
+									prog.skip(duration)
+								}
+								continue
+							}
+						}
+
+						if !started {
+							started = true
+							startTime = time.Now()
+						}
+						if !segPDT.IsZero() {
+							d.markers.recorded(segPDT)
+						}
+
+						if d.MaxGap > 0 && !segPDT.IsZero() {
+							if !lastEnd.IsZero() && segPDT.Sub(lastEnd) > d.MaxGap {
+								log.Printf("Gap of %v before %v: the stream has nothing from %v to %v.\n",
+									segPDT.Sub(lastEnd), msURI, lastEnd.Format(time.RFC3339), segPDT.Format(time.RFC3339))
+								if d.AbortOnGap {
+									d.fail(fmt.Errorf("%w: %v before %v", ErrGap, segPDT.Sub(lastEnd), msURI))
+									return
+								}
+							}
+							lastEnd = segPDT.Add(duration)
+						}
+
+						if d.UseLocalTime {
+							recDuration = time.Now().Sub(startTime)
+						} else {
+							recDuration += duration
+						}
+						var offset int64
+						if i == resumeIndex {
+							offset = resumeOffset
+						}
+						segKey, err := d.newSegmentKey(seg.key, baseURL, mpl.SeqNo+uint64(i))
+						if err != nil {
+							d.fail(err)
+							return
+						}
+						var initSeg *segment
+						if seg.xmap != nil {
+							initURI, err := d.segmentURI(baseURL, seg.xmap.URI)
+							if err != nil {
+								d.fail(err)
+								return
+							}
+							// Encrypted with the key of the segment.
+							initSeg = &segment{URI: initURI, rangeStart: seg.xmap.Offset, rangeLength: seg.xmap.Limit, key: segKey}
+						}
+						// The segments before this one and then it roll out
+						// of the live window first.
+						var deadline time.Time
+						if d.LiveDeadline && !mpl.Closed {
+							deadline = time.Now().Add(seg.end)
+						}
+						if !send(ctx, dlc, &segment{
+							URI:             msURI,
+							totalDuration:   recDuration,
+							duration:        duration,
+							progress:        prog,
+							seqNo:           mpl.SeqNo + uint64(i),
+							programDateTime: segPDT,
+							key:             segKey,
+							offset:          offset,
+							discontinuity:   v.Discontinuity || seqReset,
+							rangeStart:      seg.rangeStart,
+							rangeLength:     v.Limit,
+							deadline:        deadline,
+							init:            initSeg,
+							split:           pendingSplit,
+						}) {
+							return
+						}
+						pendingSplit = false
+						seqReset = false
+						if d.Duration != 0 && recDuration >= d.Duration {
+							log.Printf("Recorded %v of %v. Stopping.\n", recDuration, d.Duration)
+							return
+						}
+					}
+				}
+			}
+			if filtered > 0 {
+				log.Printf("Filtered out %v segments.\n", filtered)
+			}
+			if mpl.Closed || d.Mode == "vod" {
+				return
+			}
+
+			if d.Refresh > 0 {
+				sleep(ctx, d.Refresh)
+			} else {
+				sleep(ctx, time.Duration(int64(mpl.TargetDuration*1000000000)))
+			}
+
+		} else if listType == m3u8.MASTER {
+			master := playlist.(*m3u8.MasterPlaylist)
+			variant, err := d.selectVariant(master)
+			if err != nil {
+				d.fail(err)
+				return
+			}
+			if d.FollowVariantOnError {
+				fallback = newVariantFallback(master, baseURL, variant)
+			}
+			masterURL = playlistURL
+			masterFetched = time.Now()
+			playlistURL, err = baseURL.Parse(variant.URI)
+			if err != nil {
+				d.fail(err)
+				return
+			}
+			urlStr = playlistURL.String()
+			log.Printf("Selected variant %v with bandwidth %v.\n", urlStr, variant.Bandwidth)
+		} else {
+			d.fail(fmt.Errorf("%w: %v is not a media or master playlist", ErrPlaylistDecode, urlStr))
+			return
+		}
+	}
+}
+
+// playlistCursor walks through the segments of a media playlist, carrying
+// over what a segment inherits from the ones before it.
+type playlistCursor struct {
+	// An EXT-X-KEY applies to all segments up to the next one, and so does
+	// an EXT-X-MAP.
+	key  *m3u8.Key
+	xmap *m3u8.Map
+	// Segments without EXT-X-PROGRAM-DATE-TIME follow on from the previous
+	// one.
+	pdt time.Time
+	// Likewise sub-ranges without an offset start where the previous one of
+	// the same resource ended.
+	rangeURI string
+	rangeEnd int64
+	position time.Duration
+}
+
+// cursorSegment is a segment as placed by a playlistCursor.
+type cursorSegment struct {
+	start, end time.Duration // on the timeline of the playlist
+	duration   time.Duration
+	pdt        time.Time // zero if the playlist has none
+	rangeStart int64
+	key        *m3u8.Key
+	xmap       *m3u8.Map
+}
+
+// next places the segment following the previous one given.
+func (c *playlistCursor) next(v *m3u8.MediaSegment) cursorSegment {
+	if v.Key != nil {
+		c.key = v.Key
+	}
+	if v.Map != nil {
+		c.xmap = v.Map
+	}
+	s := cursorSegment{
+		start:      c.position,
+		duration:   time.Duration(int64(v.Duration * 1000000000)),
+		pdt:        c.pdt,
+		rangeStart: v.Offset,
+		key:        c.key,
+		xmap:       c.xmap,
+	}
+	c.position += s.duration
+	s.end = c.position
+	if !v.ProgramDateTime.IsZero() {
+		s.pdt = v.ProgramDateTime
+	}
+	if !s.pdt.IsZero() {
+		c.pdt = s.pdt.Add(s.duration)
+	}
+	if v.Limit > 0 {
+		if v.URI == c.rangeURI && s.rangeStart < c.rangeEnd {
+			s.rangeStart = c.rangeEnd
+		}
+		c.rangeURI, c.rangeEnd = v.URI, s.rangeStart+v.Limit
+	}
+	return s
+}
+
+// isSequenceReset tells whether a live playlist went back to an earlier media
+// sequence than lastSeqNo without overlapping it. A playlist that only lags a
+// little behind, e.g. from another server behind a load balancer, is not a
+// reset; its segments are just downloaded already.
+func isSequenceReset(mpl *m3u8.MediaPlaylist, lastSeqNo uint64) bool {
+	if mpl.SeqNo >= lastSeqNo {
+		return false
+	}
+	n := uint64(0)
+	for _, v := range mpl.Segments {
+		if v != nil {
+			n++
+		}
+	}
+	return mpl.SeqNo+n <= lastSeqNo
+}
+
+// decodePlaylist parses a playlist, strictly unless -lenient is given. Errors
+// say which mode rejected it. A byte order mark or whitespace before the
+// playlist is skipped in either mode.
+func (d *Downloader) decodePlaylist(r io.Reader, uri string) (m3u8.Playlist, m3u8.ListType, error) {
+	maxSize := d.MaxPlaylistSize
+	if maxSize > 0 {
+		r = &io.LimitedReader{R: r, N: int64(maxSize) + 1}
+	}
+	playlist, listType, err := m3u8.DecodeFrom(skipPlaylistPreamble(r), !d.Lenient)
+	if limited, ok := r.(*io.LimitedReader); ok && limited.N == 0 {
+		return nil, listType, fmt.Errorf("%w: %v is larger than the maximum playlist size of %v", ErrPlaylistDecode, uri, &maxSize)
+	}
+	if err != nil {
+		mode := "strict parsing; -lenient may accept it"
+		if d.Lenient {
+			mode = "lenient parsing"
+		}
+		return nil, listType, fmt.Errorf("%w: %v: %v (%v)", ErrPlaylistDecode, uri, err, mode)
+	}
+	return playlist, listType, nil
+}
+
+// segmentURI resolves a segment URI against the playlist URL, or
+// -segment-base if given, and applies any rewrite rules.
+func (d *Downloader) segmentURI(playlistURL *url.URL, uri string) (string, error) {
+	if d.SegmentBase != nil {
+		playlistURL = d.SegmentBase
+	}
+	var msURI string
+	var err error
+	if strings.HasPrefix(uri, "http") {
+		msURI, err = url.QueryUnescape(uri)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		msURL, err := playlistURL.Parse(uri)
+		if err != nil {
+			return "", err
+		}
+		msURI, err = url.QueryUnescape(msURL.String())
+		if err != nil {
+			return "", err
+		}
+	}
+	return d.Rewrites.apply(msURI), nil
+}
+
+// wanted applies -include and -exclude to a segment URI.
+func (d *Downloader) wanted(uri string) bool {
+	if d.Include != nil && !d.Include.MatchString(uri) {
+		return false
+	}
+	return d.Exclude == nil || !d.Exclude.MatchString(uri)
+}
+
+// precheckSegments issues a HEAD request for every segment of a VOD playlist
+// before downloading, failing fast if any is missing. It returns the total
+// size, or 0 if the server does not report it.
+func (d *Downloader) precheckSegments(ctx context.Context, playlistURL *url.URL, mpl *m3u8.MediaPlaylist) int64 {
+	var total int64
+	sizesKnown := true
+	var missing []string
+	for _, v := range mpl.Segments {
+		if v == nil {
+			continue
+		}
+		msURI, err := d.segmentURI(playlistURL, v.URI)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		resp, err := d.headRequest(ctx, msURI, segmentRequest)
+		if err != nil {
+			d.fail(err)
+			return 0
+		}
+		if resp.StatusCode == http.StatusMethodNotAllowed {
+			log.Printf("Server does not allow HEAD requests. Skipping precheck.\n")
+			return 0
+		}
+		if resp.StatusCode != 200 {
+			log.Printf("Received HTTP %v for %v\n", resp.StatusCode, msURI)
+			missing = append(missing, msURI)
+			continue
+		}
+		if resp.ContentLength < 0 {
+			sizesKnown = false
+		}
+		total += resp.ContentLength
+	}
+	if len(missing) > 0 {
+		d.fail(fmt.Errorf("Precheck failed: %v of %v segments are missing.", len(missing), len(mpl.Segments)))
+		return 0
+	}
+	if !sizesKnown {
+		log.Print("Precheck passed. Total size unknown.")
+		return 0
+	}
+	log.Printf("Precheck passed. Total size %v kb.\n", total/1000)
+	return total
+}
+
+// trimLiveEdge returns how many segments of a live playlist to record so
+// that the ones left out add up to less than trim from the live edge.
+func trimLiveEdge(mpl *m3u8.MediaPlaylist, trim time.Duration) int {
+	if trim <= 0 {
+		return len(mpl.Segments)
+	}
+	var age time.Duration
+	for i := len(mpl.Segments) - 1; i >= 0; i-- {
+		v := mpl.Segments[i]
+		if v == nil {
+			continue
+		}
+		age += time.Duration(int64(v.Duration * 1000000000))
+		if age >= trim {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func segmentDurations(mpl *m3u8.MediaPlaylist) []time.Duration {
+	var durations []time.Duration
+	for _, v := range mpl.Segments {
+		if v != nil {
+			durations = append(durations, time.Duration(int64(v.Duration*1000000000)))
+		}
+	}
+	return durations
+}
+
+func debugResponse(r *http.Response) string {
+	var request []string
+
+	request = append(request, "Headers:")
+
+	// Headers, sorted so that dumps of several responses compare easily
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headers := r.Header[name]
+		name = strings.ToLower(name)
+		for _, h := range headers {
+			request = append(request, fmt.Sprintf("%v: %v", name, h))
+		}
+	}
+
+	request = append(request, fmt.Sprintf("Status: %v", r.StatusCode))
+
+	return strings.Join(request, "\n")
+}
+
+// isStreamResponse tells whether resp is a direct stream to record as is,
+// rather than a playlist: a known audio stream type, or any successful
+// response that does not look like a playlist at all.
+func isStreamResponse(resp *http.Response) bool {
+	if isAudioStream(resp) {
+		return true
+	}
+	if resp.StatusCode != 200 {
+		return false
+	}
+	return !looksLikePlaylist(resp, peekBody(resp))
+}
+
+func isAudioStream(r *http.Response) bool {
+	streams := []string{
+		"audio/aacp",
+		"audio/mpeg",
+	}
+	isStream := false
+
+	for name, headers := range r.Header {
+		name = strings.ToLower(name)
+		if name != "content-type" {
+			continue
+		}
+
+		for _, h := range headers {
+			h = strings.ToLower(h)
+			for _, stream := range streams {
+				if stream == h {
+					isStream = true
+				}
+			}
+		}
+	}
+
+	return isStream
+}
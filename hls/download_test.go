@@ -0,0 +1,550 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bytes"
+import "context"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "log"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+import "github.com/kz26/m3u8"
+
+// record downloads uri with opts to a file in a temporary directory and
+// returns what was written.
+func record(t *testing.T, opts Options, uri string) ([]byte, error) {
+	t.Helper()
+	return recordTo(t, opts, uri, filepath.Join(t.TempDir(), "out.ts"))
+}
+
+// recordTo downloads uri with opts to fn and returns its contents.
+func recordTo(t *testing.T, opts Options, uri, fn string) ([]byte, error) {
+	t.Helper()
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 10 * time.Millisecond
+	}
+	d, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = d.Download(ctx, uri, fn)
+	data, _ := ioutil.ReadFile(fn)
+	return data, err
+}
+
+// serveFiles answers with the given bodies by path and 404 otherwise.
+func serveFiles(files map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}
+}
+
+const twoSegments = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:4
+#EXTINF:4.0,
+0.ts
+#EXTINF:4.0,
+1.ts
+#EXT-X-ENDLIST
+`
+
+func TestPlaylistRetry(t *testing.T) {
+	files := serveFiles(map[string]string{"/p.m3u8": twoSegments, "/0.ts": "zero", "/1.ts": "one"})
+	var failures int32 = 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/p.m3u8" && atomic.AddInt32(&failures, -1) >= 0 {
+			http.Error(w, "<html>Service Unavailable</html>", http.StatusServiceUnavailable)
+			return
+		}
+		files(w, r)
+	}))
+	defer srv.Close()
+
+	data, err := record(t, Options{}, srv.URL+"/p.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "zeroone" {
+		t.Errorf("got %q, want %q", data, "zeroone")
+	}
+	if failures >= 0 {
+		t.Errorf("the playlist was not retried")
+	}
+}
+
+const threeSegments = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:4
+#EXTINF:4.0,
+0.ts
+#EXTINF:4.0,
+1.ts
+#EXTINF:4.0,
+2.ts
+#EXT-X-ENDLIST
+`
+
+func TestSkip(t *testing.T) {
+	srv := httptest.NewServer(serveFiles(map[string]string{"/p.m3u8": threeSegments, "/0.ts": "zero", "/1.ts": "one", "/2.ts": "two"}))
+	defer srv.Close()
+
+	tests := []struct {
+		skip time.Duration
+		want string
+	}{
+		{0, "zeroonetwo"},
+		{3 * time.Second, "zeroonetwo"},
+		// The segment spanning the skip point is kept.
+		{6 * time.Second, "onetwo"},
+		{8 * time.Second, "two"},
+		{9 * time.Second, "two"},
+	}
+	for _, tt := range tests {
+		data, err := record(t, Options{Skip: tt.skip}, srv.URL+"/p.m3u8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("-skip %v: got %q, want %q", tt.skip, data, tt.want)
+		}
+	}
+
+	// -t counts what is recorded, not what is skipped.
+	data, err := record(t, Options{Skip: 4 * time.Second, Duration: 4 * time.Second}, srv.URL+"/p.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "one" {
+		t.Errorf("-skip 4s -t 4s: got %q, want %q", data, "one")
+	}
+}
+
+func TestSince(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:4
+#EXT-X-PROGRAM-DATE-TIME:2024-05-06T18:00:00Z
+#EXTINF:4.0,
+0.ts
+#EXTINF:4.0,
+1.ts
+#EXT-X-PROGRAM-DATE-TIME:2024-05-06T18:00:10Z
+#EXTINF:4.0,
+2.ts
+#EXT-X-ENDLIST
+`
+	srv := httptest.NewServer(serveFiles(map[string]string{"/p.m3u8": playlist, "/0.ts": "zero", "/1.ts": "one", "/2.ts": "two"}))
+	defer srv.Close()
+
+	start := time.Date(2024, 5, 6, 18, 0, 0, 0, time.UTC)
+	tests := []struct {
+		since time.Duration // after the first segment starts
+		want  string
+	}{
+		{0, "zeroonetwo"},
+		{4 * time.Second, "onetwo"},
+		// The segment straddling -since is kept.
+		{6 * time.Second, "onetwo"},
+		// The third segment has a date of its own, after a gap.
+		{9 * time.Second, "two"},
+		{11 * time.Second, "two"},
+		{14 * time.Second, ""},
+	}
+	for _, tt := range tests {
+		data, err := record(t, Options{Since: start.Add(tt.since)}, srv.URL+"/p.m3u8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("-since +%v: got %q, want %q", tt.since, data, tt.want)
+		}
+	}
+}
+
+// decodeMedia parses a media playlist for tests of the helpers taking one.
+func decodeMedia(t *testing.T, s string) *m3u8.MediaPlaylist {
+	t.Helper()
+	playlist, listType, err := m3u8.DecodeFrom(strings.NewReader(s), true)
+	if err != nil || listType != m3u8.MEDIA {
+		t.Fatalf("could not decode test playlist: %v", err)
+	}
+	return playlist.(*m3u8.MediaPlaylist)
+}
+
+func TestTrimLiveEdge(t *testing.T) {
+	mpl := decodeMedia(t, `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:20
+#EXTINF:4.0,
+20.ts
+#EXTINF:4.0,
+21.ts
+#EXTINF:6.0,
+22.ts
+#EXTINF:2.0,
+23.ts
+`)
+	tests := []struct {
+		trim time.Duration
+		want int
+	}{
+		{0, len(mpl.Segments)},
+		{2 * time.Second, 4},
+		// 23.ts is newer than -trim-end.
+		{3 * time.Second, 3},
+		{8 * time.Second, 3},
+		{9 * time.Second, 2},
+		{12 * time.Second, 2},
+		{16 * time.Second, 1},
+		{17 * time.Second, 0},
+		{time.Hour, 0},
+	}
+	for _, tt := range tests {
+		if got := trimLiveEdge(mpl, tt.trim); got != tt.want {
+			t.Errorf("trimLiveEdge(%v) = %v, want %v", tt.trim, got, tt.want)
+		}
+	}
+}
+
+func TestIsSequenceReset(t *testing.T) {
+	window := func(seq int) *m3u8.MediaPlaylist {
+		return decodeMedia(t, fmt.Sprintf(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:%v
+#EXTINF:4.0,
+a.ts
+#EXTINF:4.0,
+b.ts
+#EXTINF:4.0,
+c.ts
+`, seq))
+	}
+	tests := []struct {
+		seq       int
+		lastSeqNo uint64
+		want      bool
+	}{
+		{100, 100, false},
+		{101, 100, false},
+		// A server lagging behind still overlaps the last reload.
+		{98, 100, false},
+		{97, 99, false},
+		{97, 100, true},
+		{0, 100, true},
+	}
+	for _, tt := range tests {
+		if got := isSequenceReset(window(tt.seq), tt.lastSeqNo); got != tt.want {
+			t.Errorf("isSequenceReset(%v after %v) = %v, want %v", tt.seq, tt.lastSeqNo, got, tt.want)
+		}
+	}
+}
+
+func TestSequenceReset(t *testing.T) {
+	before := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:100
+#EXTINF:4.0,
+a.ts
+#EXTINF:4.0,
+b.ts
+`
+	// The encoder restarted and numbers its segments from 0 again.
+	after := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:0
+#EXTINF:4.0,
+a.ts
+#EXT-X-ENDLIST
+`
+	var restarted int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/p.m3u8":
+			if atomic.LoadInt32(&restarted) == 1 {
+				w.Write([]byte(after))
+			} else {
+				w.Write([]byte(before))
+			}
+		case "/a.ts":
+			if atomic.LoadInt32(&restarted) == 1 {
+				w.Write([]byte("new a"))
+			} else {
+				w.Write([]byte("old a"))
+			}
+		case "/b.ts":
+			w.Write([]byte("b"))
+			atomic.StoreInt32(&restarted, 1)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	data, err := record(t, Options{Refresh: 10 * time.Millisecond}, srv.URL+"/p.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "old abnew a"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	before := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:100
+#EXTINF:4.0,
+a.ts
+#EXTINF:4.0,
+b.ts
+`
+	// The encoder reuses a.ts for the next segment.
+	after := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:101
+#EXTINF:4.0,
+b.ts
+#EXTINF:4.0,
+a.ts
+#EXT-X-ENDLIST
+`
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"uri", "old ab"},
+		{"seq+uri", "old abnew a"},
+	}
+	for _, test := range tests {
+		var reused int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/p.m3u8":
+				if atomic.LoadInt32(&reused) == 1 {
+					w.Write([]byte(after))
+				} else {
+					w.Write([]byte(before))
+				}
+			case "/a.ts":
+				if atomic.LoadInt32(&reused) == 1 {
+					w.Write([]byte("new a"))
+				} else {
+					w.Write([]byte("old a"))
+				}
+			case "/b.ts":
+				w.Write([]byte("b"))
+				atomic.StoreInt32(&reused, 1)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		data, err := record(t, Options{Refresh: 10 * time.Millisecond, DedupKey: test.key}, srv.URL+"/p.m3u8")
+		srv.Close()
+		if err != nil {
+			t.Fatalf("-dedup-key %v: %v", test.key, err)
+		}
+		if string(data) != test.want {
+			t.Errorf("-dedup-key %v: got %q, want %q", test.key, data, test.want)
+		}
+	}
+}
+
+func TestSegmentURI(t *testing.T) {
+	playlistURL, _ := url.Parse("http://example.com/live/p.m3u8")
+	cdn, _ := url.Parse("https://cdn.example.net/media/show/")
+	tests := []struct {
+		base *url.URL
+		uri  string
+		want string
+	}{
+		{nil, "0.ts", "http://example.com/live/0.ts"},
+		{cdn, "0.ts", "https://cdn.example.net/media/show/0.ts"},
+		{cdn, "hd/0.ts", "https://cdn.example.net/media/show/hd/0.ts"},
+		{cdn, "../other/0.ts", "https://cdn.example.net/media/other/0.ts"},
+		{cdn, "/0.ts", "https://cdn.example.net/0.ts"},
+		// Absolute segment URIs are left alone.
+		{cdn, "http://origin.example.org/0.ts", "http://origin.example.org/0.ts"},
+	}
+	for _, tt := range tests {
+		d := &Downloader{Options: Options{SegmentBase: tt.base}}
+		got, err := d.segmentURI(playlistURL, tt.uri)
+		if err != nil {
+			t.Errorf("segmentURI(%q): %v", tt.uri, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("segmentURI(%q) with -segment-base %v = %v, want %v", tt.uri, tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestDecodePlaylistLenient(t *testing.T) {
+	// A date without the T, as some encoders write it.
+	malformed := strings.Replace(twoSegments, "#EXTINF:4.0,\n0.ts", "#EXT-X-PROGRAM-DATE-TIME:2024-05-06 18:00:00\n#EXTINF:4.0,\n0.ts", 1)
+	tests := []struct {
+		lenient bool
+		ok      bool
+		mode    string
+	}{
+		{false, false, "strict parsing; -lenient may accept it"},
+		{true, true, ""},
+	}
+	for _, tt := range tests {
+		d, err := New(Options{Lenient: tt.lenient})
+		if err != nil {
+			t.Fatal(err)
+		}
+		playlist, _, err := d.decodePlaylist(strings.NewReader(malformed), "p.m3u8")
+		if !tt.ok {
+			if !errors.Is(err, ErrPlaylistDecode) || !strings.Contains(err.Error(), tt.mode) {
+				t.Errorf("lenient %v: got error %v, want one mentioning %q", tt.lenient, err, tt.mode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("lenient %v: %v", tt.lenient, err)
+			continue
+		}
+		if n := len(segmentDurations(playlist.(*m3u8.MediaPlaylist))); n != 2 {
+			t.Errorf("lenient %v: got %v segments, want 2", tt.lenient, n)
+		}
+	}
+}
+
+func TestDecodePlaylistMaxSize(t *testing.T) {
+	// Comments padding a playlist to a megabyte.
+	huge := strings.Replace(twoSegments, "#EXT-X-ENDLIST\n", strings.Repeat("# padding\n", 100000)+"#EXT-X-ENDLIST\n", 1)
+	tests := []struct {
+		body    string
+		maxSize ByteSize
+		ok      bool
+	}{
+		{twoSegments, 0, true},
+		{twoSegments, ByteSize(len(twoSegments)), true},
+		{twoSegments, ByteSize(len(twoSegments) - 1), false},
+		{huge, 0, true},
+		{huge, 4096, false},
+	}
+	for _, tt := range tests {
+		d := &Downloader{Options: Options{MaxPlaylistSize: tt.maxSize}}
+		r := strings.NewReader(tt.body)
+		_, _, err := d.decodePlaylist(r, "p.m3u8")
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%v bytes, maximum %v: %v", len(tt.body), tt.maxSize, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrPlaylistDecode) || !strings.Contains(err.Error(), "larger than the maximum playlist size") {
+			t.Errorf("%v bytes, maximum %v: got %v", len(tt.body), tt.maxSize, err)
+		}
+		// The rest of the body is left unread.
+		if read := int64(len(tt.body)) - int64(r.Len()); read > int64(tt.maxSize)+1 {
+			t.Errorf("%v bytes, maximum %v: read %v bytes", len(tt.body), tt.maxSize, read)
+		}
+	}
+}
+
+func TestEmptySegment(t *testing.T) {
+	for _, retries := range []int{0, 1} {
+		var empty int32 = 1
+		files := serveFiles(map[string]string{"/p.m3u8": twoSegments, "/0.ts": "zero", "/1.ts": "one"})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/0.ts" && atomic.AddInt32(&empty, -1) >= 0 {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			files(w, r)
+		}))
+		data, err := record(t, Options{Retries: retries}, srv.URL+"/p.m3u8")
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The empty response is not taken for the segment.
+		want := "one"
+		if retries > 0 {
+			want = "zeroone"
+		}
+		if string(data) != want {
+			t.Errorf("-retries %v: got %q, want %q", retries, data, want)
+		}
+	}
+}
+
+func TestPutSegmentBuffer(t *testing.T) {
+	huge := bytes.NewBuffer(make([]byte, 0, maxPooledBuffer+1))
+	putSegmentBuffer(huge)
+	if segmentBuffers.Get().(*bytes.Buffer) == huge {
+		t.Error("a buffer above maxPooledBuffer was kept")
+	}
+}
+
+// BenchmarkDownloadVOD records a VOD of many segments, to show the memory
+// allocated per segment.
+func BenchmarkDownloadVOD(b *testing.B) {
+	const segments = 200
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n"
+	for i := 0; i < segments; i++ {
+		playlist += fmt.Sprintf("#EXTINF:4.0,\n%v.ts\n", i)
+	}
+	playlist += "#EXT-X-ENDLIST\n"
+	segment := bytes.Repeat([]byte{0x47}, 256*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/p.m3u8" {
+			w.Write([]byte(playlist))
+		} else {
+			w.Write(segment)
+		}
+	}))
+	defer srv.Close()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := b.TempDir()
+	b.ReportAllocs()
+	b.SetBytes(segments * int64(len(segment)))
+	for i := 0; i < b.N; i++ {
+		d, err := New(Options{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		fn := filepath.Join(dir, fmt.Sprintf("out%v.ts", i))
+		if err := d.Download(context.Background(), srv.URL+"/p.m3u8", fn); err != nil {
+			b.Fatal(err)
+		}
+		os.Remove(fn)
+	}
+}
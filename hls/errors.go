@@ -0,0 +1,37 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "errors"
+import "sync/atomic"
+
+// Failure modes returned by Downloader.Download, wrapped with the details.
+var (
+	ErrHTTP           = errors.New("HTTP request failed")
+	ErrPlaylistDecode = errors.New("invalid playlist")
+	ErrAuth           = errors.New("not authorized")
+	ErrSegmentGone    = errors.New("segments missing")
+	ErrStreamEnded    = errors.New("stream ended")
+	ErrStalled        = errors.New("recording stalled")
+	ErrGap            = errors.New("content missing")
+)
+
+// segmentGone counts a segment the server answered 404 or 410 for.
+func (d *Downloader) segmentGone() {
+	atomic.AddInt64(&d.goneSegments, 1)
+}
@@ -0,0 +1,198 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "fmt"
+import "net"
+import "time"
+
+// Happy Eyeballs (RFC 8305) timings.
+const (
+	// How long to wait for the other address family after the first DNS
+	// answer with addresses.
+	resolutionDelay = 50 * time.Millisecond
+	// How long a connection attempt gets before the next one is started
+	// alongside it.
+	connectionAttemptDelay = 250 * time.Millisecond
+)
+
+// hostResolver looks up the addresses of a host for one address family,
+// "ip4" or "ip6". net.DefaultResolver is one.
+type hostResolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// happyEyeballs dials hosts with both IPv4 and IPv6 addresses by racing
+// connection attempts over both families, so a broken or slow family only
+// costs a fraction of a second instead of a full connect timeout.
+type happyEyeballs struct {
+	resolver hostResolver
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+	delay    time.Duration // connection attempt delay
+}
+
+// newHappyEyeballs returns a dialer giving each connection attempt up to
+// timeout.
+func newHappyEyeballs(timeout time.Duration) *happyEyeballs {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		// The racing is done here.
+		FallbackDelay: -1,
+	}
+	return &happyEyeballs{resolver: net.DefaultResolver, dial: dialer.DialContext, delay: connectionAttemptDelay}
+}
+
+func (h *happyEyeballs) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil || network != "tcp" {
+		return h.dial(ctx, network, address)
+	}
+	ips, err := h.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return h.race(ctx, network, ips, port)
+}
+
+// resolve looks up both address families at the same time. Once one has
+// answered with addresses, the other gets resolutionDelay more; a failed
+// or empty answer does not count, as the other family may be all there
+// is. The addresses are returned alternating between the families,
+// starting with IPv6.
+func (h *happyEyeballs) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	type answer struct {
+		family string
+		ips    []net.IP
+		err    error
+	}
+	answers := make(chan answer, 2)
+	for _, family := range []string{"ip6", "ip4"} {
+		go func(family string) {
+			ips, err := h.resolver.LookupIP(ctx, family, host)
+			answers <- answer{family, ips, err}
+		}(family)
+	}
+
+	var v4, v6 []net.IP
+	var firstErr error
+	var timeout <-chan time.Time
+	for n := 0; n < 2; n++ {
+		select {
+		case a := <-answers:
+			if a.err != nil && firstErr == nil {
+				firstErr = a.err
+			}
+			if a.family == "ip6" {
+				v6 = a.ips
+			} else {
+				v4 = a.ips
+			}
+			if timeout == nil && len(a.ips) > 0 {
+				timeout = time.After(resolutionDelay)
+			}
+		case <-timeout:
+			n = 2
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var ips []net.IP
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ips = append(ips, v6[i])
+		}
+		if i < len(v4) {
+			ips = append(ips, v4[i])
+		}
+	}
+	if len(ips) == 0 {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("no addresses for %v", host)
+		}
+		return nil, firstErr
+	}
+	return ips, nil
+}
+
+// race starts a connection attempt to each address in turn, the next one
+// after delay or as soon as the previous one failed, and returns the first
+// connection made.
+func (h *happyEyeballs) race(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	// closeLosers closes the connections of attempts still running.
+	closeLosers := func() {
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}(pending)
+	}
+	start := func() {
+		address := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := h.dial(ctx, network, address)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(h.delay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				closeLosers()
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+				timer.Reset(h.delay)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		case <-ctx.Done():
+			closeLosers()
+			return nil, ctx.Err()
+		}
+	}
+}
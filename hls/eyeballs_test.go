@@ -0,0 +1,123 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "errors"
+import "fmt"
+import "net"
+import "testing"
+import "time"
+
+// fakeResolver answers each address family after a delay.
+type fakeResolver map[string]fakeAnswer
+
+type fakeAnswer struct {
+	delay time.Duration
+	ips   []string
+	err   error
+}
+
+func (r fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	a := r[network]
+	select {
+	case <-time.After(a.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var ips []net.IP
+	for _, s := range a.ips {
+		ips = append(ips, net.ParseIP(s))
+	}
+	return ips, a.err
+}
+
+func TestResolve(t *testing.T) {
+	noAAAA := errors.New("no AAAA records")
+	tests := []struct {
+		name     string
+		resolver fakeResolver
+		want     string
+	}{
+		{"interleaved", fakeResolver{
+			"ip6": {0, []string{"::1", "::2"}, nil},
+			"ip4": {0, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, nil},
+		}, "[::1 10.0.0.1 ::2 10.0.0.2 10.0.0.3]"},
+		// A failed AAAA lookup does not cut the wait for A short.
+		{"failing AAAA", fakeResolver{
+			"ip6": {0, nil, noAAAA},
+			"ip4": {4 * resolutionDelay, []string{"10.0.0.1"}, nil},
+		}, "[10.0.0.1]"},
+		{"empty AAAA", fakeResolver{
+			"ip6": {0, nil, nil},
+			"ip4": {4 * resolutionDelay, []string{"10.0.0.1"}, nil},
+		}, "[10.0.0.1]"},
+		// A slow family is given up on resolutionDelay after the other.
+		{"slow AAAA", fakeResolver{
+			"ip6": {time.Minute, []string{"::1"}, nil},
+			"ip4": {0, []string{"10.0.0.1"}, nil},
+		}, "[10.0.0.1]"},
+	}
+	for _, tt := range tests {
+		h := &happyEyeballs{resolver: tt.resolver}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ips, err := h.resolve(ctx, "example.com")
+		cancel()
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if got := fmt.Sprint(ips); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	h := &happyEyeballs{resolver: fakeResolver{"ip6": {0, nil, noAAAA}, "ip4": {0, nil, nil}}}
+	if _, err := h.resolve(context.Background(), "example.com"); err != noAAAA {
+		t.Errorf("got %v without addresses, want %v", err, noAAAA)
+	}
+}
+
+func TestRace(t *testing.T) {
+	// The first address never connects, the second one fails and the third
+	// one works.
+	dialed := make(chan string, 3)
+	h := &happyEyeballs{delay: 10 * time.Millisecond, dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed <- address
+		switch address {
+		case "[::1]:80":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case "10.0.0.1:80":
+			return nil, errors.New("connection refused")
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	}}
+	ips := []net.IP{net.ParseIP("::1"), net.ParseIP("10.0.0.1"), net.ParseIP("::2")}
+	conn, err := h.race(context.Background(), "tcp", ips, "80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	for _, want := range []string{"[::1]:80", "10.0.0.1:80", "[::2]:80"} {
+		if got := <-dialed; got != want {
+			t.Errorf("dialed %v, want %v", got, want)
+		}
+	}
+}
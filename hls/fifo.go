@@ -0,0 +1,68 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "errors"
+import "log"
+import "os"
+import "syscall"
+
+// isFIFO reports whether name is an existing named pipe.
+func isFIFO(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// openFIFO opens a named pipe for writing, which waits until a reader such
+// as ffmpeg opens the other end or ctx is done. The open cannot be
+// interrupted, so it is left to finish in the background then.
+func openFIFO(ctx context.Context, name string) (*os.File, error) {
+	log.Printf("Waiting for a reader on %v.\n", name)
+	type result struct {
+		f   *os.File
+		err error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		f, err := os.OpenFile(name, os.O_WRONLY, 0)
+		opened <- result{f, err}
+	}()
+	select {
+	case r := <-opened:
+		return r.f, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-opened; r.f != nil {
+				r.f.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// writeFailed handles an error writing the output. If it is a pipe whose
+// reader went away, the recording stops normally.
+func (d *Downloader) writeFailed(err error) {
+	if !errors.Is(err, syscall.EPIPE) {
+		d.fail(err)
+		return
+	}
+	log.Print("The reader of the output went away. Stopping.")
+	d.stop()
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "os"
+import "path/filepath"
+import "syscall"
+import "testing"
+import "time"
+
+func TestOpenFIFO(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "pipe")
+	if err := syscall.Mkfifo(fn, 0600); err != nil {
+		t.Skip(err)
+	}
+
+	// Without a reader, it gives up when ctx is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := (fileSink{}).open(ctx, fn); err != context.DeadlineExceeded {
+		t.Errorf("got %v without a reader, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("gave up after %v", elapsed)
+	}
+
+	// With one, it opens.
+	r, err := os.OpenFile(fn, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w, err := (fileSink{}).open(context.Background(), fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
@@ -0,0 +1,143 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "fmt"
+import "log"
+import "os"
+import "time"
+
+// checkFirstSegment downloads only the first segment of a playlist, with
+// keys and authentication applied, to a temporary file and reports what it
+// holds. It is a quick check that a stream can be recorded.
+func (d *Downloader) checkFirstSegment(ctx context.Context, uri string) error {
+	listCtx, cancel := context.WithCancel(ctx)
+	dlc := make(chan *segment, 1)
+	go d.getPlaylist(listCtx, uri, dlc)
+	v, ok := <-dlc
+	cancel()
+	if !ok {
+		if err := d.result(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %v has no segments", ErrPlaylistDecode, uri)
+	}
+	if v.duration == 0 {
+		return fmt.Errorf("%v is a direct stream, not a playlist", uri)
+	}
+
+	v.progress = nil
+	buf, ok := d.fetchData(ctx, v)
+	defer putSegmentBuffer(buf)
+	if !ok {
+		if err := d.result(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: could not download %v", ErrHTTP, v.URI)
+	}
+
+	data := buf.Bytes()
+	ext := sniffExtension(data)
+	f, err := os.CreateTemp("", "gohls-first-*"+ext)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if !d.KeepTemp {
+		defer os.Remove(f.Name())
+	}
+
+	format := "unknown format"
+	if ext != "" {
+		format = ext[1:]
+	}
+	if len(data) > probeBytes {
+		data = data[:probeBytes]
+	}
+	if streams := findStreams(data); streams != nil {
+		format += " " + describeStreams(streams)
+	}
+	log.Printf("First segment %v: %v bytes, %v, %v long.\n", v.URI, buf.Len(), format, v.duration)
+	if d.KeepTemp {
+		log.Printf("Saved it to %v.\n", f.Name())
+	}
+	return nil
+}
+
+// probeBitrate downloads segments until -probe-duration of media is in,
+// without writing them anywhere, and reports the average bitrate and, for
+// a VOD, the size of a whole recording.
+func (d *Downloader) probeBitrate(ctx context.Context, uri string) error {
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dlc := make(chan *segment, 1)
+	go d.getPlaylist(listCtx, uri, dlc)
+
+	var media time.Duration
+	var size int64
+	var prog *progress
+	n := 0
+	for v := range dlc {
+		if v.duration == 0 {
+			return fmt.Errorf("%v is a direct stream, not a playlist", uri)
+		}
+		prog = v.progress
+		v.progress = nil
+		buf, ok := d.fetchData(ctx, v)
+		written := buf.Len()
+		putSegmentBuffer(buf)
+		if !ok {
+			if err := d.result(); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: could not download %v", ErrHTTP, v.URI)
+		}
+		media += v.duration
+		size += int64(written)
+		n++
+		if media >= d.ProbeDuration {
+			break
+		}
+	}
+	cancel()
+	if n == 0 {
+		if err := d.result(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %v has no segments", ErrPlaylistDecode, uri)
+	}
+
+	perSecond := float64(size) / media.Seconds()
+	log.Printf("Sampled %v segments with %v of media in %v bytes: %v kb/s.\n", n, media, size, int64(perSecond*8/1000))
+	if prog != nil {
+		prog.mu.Lock()
+		total := prog.totalDuration
+		prog.mu.Unlock()
+		log.Printf("Recording all %v would take about %.1f MB.\n", total, perSecond*total.Seconds()/(1<<20))
+	} else {
+		log.Printf("Recording the live stream takes about %.1f MB per hour.\n", perSecond*3600/(1<<20))
+	}
+	return nil
+}
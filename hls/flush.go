@@ -0,0 +1,74 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bufio"
+import "io"
+import "os"
+import "time"
+
+// flushBufferSize is how much a segmentFlusher holds at most. It batches the
+// packet sized writes of e.g. -only-audio into larger ones.
+const flushBufferSize = 64 << 10
+
+// segmentFlusher buffers the writes to a streaming output, such as a pipe or
+// an upload, and flushes them at the end of every segment so the reader gets
+// each segment whole and without delay. With an interval it only flushes
+// once that much time passed since the last flush, batching short segments.
+type segmentFlusher struct {
+	*bufio.Writer
+	dst      io.WriteCloser
+	interval time.Duration
+	last     time.Time
+}
+
+func newSegmentFlusher(dst io.WriteCloser, interval time.Duration) *segmentFlusher {
+	return &segmentFlusher{
+		Writer:   bufio.NewWriterSize(dst, flushBufferSize),
+		dst:      dst,
+		interval: interval,
+		last:     time.Now(),
+	}
+}
+
+func (f *segmentFlusher) endSegment() error {
+	if f.interval > 0 && time.Since(f.last) < f.interval {
+		return nil
+	}
+	f.last = time.Now()
+	return f.Flush()
+}
+
+func (f *segmentFlusher) Close() error {
+	err := f.Flush()
+	if e := f.dst.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// isStreaming tells whether w is something other than a regular local file,
+// whose reader is waiting for the data.
+func isStreaming(w io.Writer) bool {
+	f := localFile(w)
+	if f == nil {
+		return true
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&(os.ModeNamedPipe|os.ModeSocket|os.ModeCharDevice) != 0
+}
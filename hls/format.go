@@ -0,0 +1,150 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bufio"
+import "bytes"
+import "io"
+import "mime"
+import "net/http"
+import "path"
+import "path/filepath"
+import "strings"
+
+// playlistTypes are the Content-Types HLS playlists are served with.
+var playlistTypes = map[string]bool{
+	"application/vnd.apple.mpegurl": true,
+	"application/x-mpegurl":         true,
+	"audio/mpegurl":                 true,
+	"audio/x-mpegurl":               true,
+}
+
+// playlistHeader starts every HLS playlist, though some servers put a
+// byte order mark or whitespace before it.
+const playlistHeader = "#EXTM3U"
+
+const utf8BOM = "\xef\xbb\xbf"
+
+// headSize is how much of a body peekBody returns, leaving room for a byte
+// order mark and some whitespace before playlistHeader.
+const headSize = 64
+
+// peekBody returns the first bytes of resp's body, enough for
+// looksLikePlaylist, and puts them back for later readers.
+func peekBody(resp *http.Response) []byte {
+	head := make([]byte, headSize)
+	n, _ := io.ReadFull(resp.Body, head)
+	head = head[:n]
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	return head
+}
+
+// looksLikePlaylist tells whether resp is plausibly an HLS playlist, going
+// by its Content-Type, the extension of the URL it was finally served from
+// after redirects, or head, the start of its body.
+func looksLikePlaylist(resp *http.Response, head []byte) bool {
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && playlistTypes[strings.ToLower(mediaType)] {
+		return true
+	}
+	if resp.Request != nil {
+		switch strings.ToLower(path.Ext(resp.Request.URL.Path)) {
+		case ".m3u8", ".m3u":
+			return true
+		}
+	}
+	head = bytes.TrimLeft(bytes.TrimPrefix(head, []byte(utf8BOM)), " \t\r\n")
+	return bytes.HasPrefix(head, []byte(playlistHeader))
+}
+
+// skipPlaylistPreamble returns r without a leading byte order mark and
+// whitespace, which the playlist parser would reject.
+func skipPlaylistPreamble(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(len(utf8BOM)); err == nil && string(bom) == utf8BOM {
+		br.Discard(len(utf8BOM))
+	}
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return br
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			br.UnreadByte()
+			return br
+		}
+	}
+}
+
+var contentTypeExtensions = map[string]string{
+	"video/mp2t": ".ts",
+	"audio/aac":  ".aac",
+	"audio/aacp": ".aac",
+	"audio/mpeg": ".mp3",
+	"audio/mp4":  ".m4a",
+	"video/mp4":  ".mp4",
+	"text/vtt":   ".vtt",
+}
+
+// extensionForType returns the file extension for a Content-Type header, or
+// "" if it is unknown.
+func extensionForType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return contentTypeExtensions[mediaType]
+}
+
+// sniffExtension returns the file extension for the format of a segment
+// from its first bytes, or "" if it is unknown.
+func sniffExtension(b []byte) string {
+	// Packed audio segments start with an ID3 tag carrying the timestamp.
+	if len(b) >= 10 && string(b[:3]) == "ID3" {
+		size := int(b[6]&0x7f)<<21 | int(b[7]&0x7f)<<14 | int(b[8]&0x7f)<<7 | int(b[9]&0x7f)
+		if 10+size >= len(b) {
+			return ""
+		}
+		b = b[10+size:]
+	}
+	switch {
+	case len(b) > tsPacketSize && b[0] == tsSyncByte && b[tsPacketSize] == tsSyncByte:
+		return ".ts"
+	case len(b) >= 8 && string(b[4:8]) == "ftyp":
+		return ".mp4"
+	case len(b) >= 8 && (string(b[4:8]) == "styp" || string(b[4:8]) == "moof" || string(b[4:8]) == "sidx"):
+		return ".m4s"
+	case bytes.HasPrefix(b, []byte("WEBVTT")):
+		return ".vtt"
+	case len(b) >= 2 && b[0] == 0xff && b[1]&0xf6 == 0xf0:
+		return ".aac"
+	case len(b) >= 2 && b[0] == 0xff && b[1]&0xe0 == 0xe0:
+		return ".mp3"
+	}
+	return ""
+}
+
+// withExtension appends ext to fn unless fn already ends with it.
+func withExtension(fn, ext string) string {
+	if ext == "" || strings.EqualFold(filepath.Ext(fn), ext) {
+		return fn
+	}
+	return fn + ext
+}
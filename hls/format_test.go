@@ -0,0 +1,88 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "io/ioutil"
+import "net/http"
+import "net/url"
+import "strings"
+import "testing"
+
+func TestLooksLikePlaylist(t *testing.T) {
+	tests := []struct {
+		contentType string
+		finalURL    string
+		head        string
+		want        bool
+	}{
+		{"application/vnd.apple.mpegurl", "http://example.com/live", "", true},
+		{"application/x-mpegURL", "http://example.com/live", "", true},
+		{"audio/mpegurl", "http://example.com/live", "", true},
+		{"audio/x-mpegurl; charset=utf-8", "http://example.com/live", "", true},
+		// Redirected to a playlist.
+		{"application/octet-stream", "http://cdn.example.com/hls/index.m3u8", "", true},
+		{"text/plain", "http://cdn.example.com/radio.M3U", "", true},
+		// Served with a generic type, recognized by its contents.
+		{"text/plain", "http://example.com/live", "#EXTM3U\n#EXT-X-VERSION:3\n", true},
+		{"", "http://example.com/live", "#EXTM3U\n", true},
+		{"audio/mpeg", "http://example.com/live", "ID3\x04\x00", false},
+		{"video/mp2t", "http://example.com/live.ts", "G@\x00\x10", false},
+		{"text/html", "http://example.com/live", "<html><body>Not found</body></html>", false},
+		{"application/octet-stream", "http://example.com/live", "", false},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.finalURL)
+		resp := &http.Response{
+			Header:  http.Header{"Content-Type": {tt.contentType}},
+			Request: &http.Request{URL: u},
+		}
+		if got := looksLikePlaylist(resp, []byte(tt.head)); got != tt.want {
+			t.Errorf("looksLikePlaylist(%q, %v, %q) = %v, want %v", tt.contentType, tt.finalURL, tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestSkipPlaylistPreamble(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"#EXTM3U\n", "#EXTM3U\n"},
+		{utf8BOM + "#EXTM3U\n", "#EXTM3U\n"},
+		{"\r\n \t\n#EXTM3U\n", "#EXTM3U\n"},
+		{utf8BOM + "\n\n#EXTM3U\n", "#EXTM3U\n"},
+		// Only a leading BOM is skipped.
+		{"#EXTM3U\n" + utf8BOM, "#EXTM3U\n" + utf8BOM},
+		{utf8BOM, ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := ioutil.ReadAll(skipPlaylistPreamble(strings.NewReader(tt.body)))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("skipPlaylistPreamble(%q) = %q, %v, want %q", tt.body, got, err, tt.want)
+		}
+	}
+
+	// Both modes accept a playlist with a BOM.
+	for _, lenient := range []bool{false, true} {
+		d := &Downloader{Options: Options{Lenient: lenient}}
+		if _, _, err := d.decodePlaylist(strings.NewReader(utf8BOM+twoSegments), "p.m3u8"); err != nil {
+			t.Errorf("lenient %v: %v", lenient, err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "fmt"
+import "log"
+import "net/http"
+import "os"
+import "sync"
+import "time"
+
+// headerLog appends the headers of every response to the -dump-headers file.
+type headerLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openHeaderLog(fn string) (*headerLog, error) {
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &headerLog{f: f}, nil
+}
+
+func (h *headerLog) dump(req *http.Request, resp *http.Response) {
+	uri := req.URL.String()
+	if resp.Request != nil && resp.Request.URL.String() != uri {
+		uri += " -> " + resp.Request.URL.String()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := fmt.Fprintf(h.f, "%v %v %v\n%v\n\n", time.Now().Format(time.RFC3339Nano), req.Method, uri, debugResponse(resp))
+	if err != nil {
+		log.Printf("Could not write to the header dump. %v\n", err)
+	}
+}
+
+func (h *headerLog) Close() error {
+	return h.f.Close()
+}
+
+// roundTrip sends req, recording the response headers for -dump-headers.
+func (d *Downloader) roundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := d.client.Do(req)
+	if err == nil && d.headers != nil {
+		d.headers.dump(req, resp)
+	}
+	return resp, err
+}
@@ -0,0 +1,706 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+// Package hls records HTTP Live Streaming (and MPEG-DASH) streams to files.
+// It is the engine of the gohls command:
+//
+//	d, err := hls.New(hls.Options{Duration: time.Hour})
+//	if err != nil {
+//		return err
+//	}
+//	err = d.Download(ctx, "https://example.com/live.m3u8", "live.ts")
+//
+// Progress is reported with the standard log package.
+package hls
+
+import "context"
+import "errors"
+import "fmt"
+import "io"
+import "log"
+import "net"
+import "net/url"
+import "net/http"
+import "os"
+import "path/filepath"
+import "regexp"
+import "sync"
+import "sync/atomic"
+import "text/template"
+import "time"
+
+// Options configures a Downloader. The zero value records a stream as is
+// until it ends.
+type Options struct {
+	// Duration stops the recording after this much media (0 == until the
+	// stream ends).
+	Duration time.Duration
+	// UseLocalTime measures Duration in wall-clock time instead of by the
+	// segment durations.
+	UseLocalTime bool
+	// QueueSize is the number of segments queued between the playlist
+	// poller and the downloader.
+	QueueSize int
+	UserAgent string
+	// User-Agents for playlist (and manifest), segment and key requests
+	// instead of UserAgent.
+	PlaylistUserAgent string
+	SegmentUserAgent  string
+	KeyUserAgent      string
+	// PlaylistAccept is the Accept header of playlist and manifest
+	// requests, for origins that only serve the playlist when asked for
+	// its type.
+	PlaylistAccept string
+
+	// Variant selection for master playlists, in bits/s. A MaxBandwidth
+	// of 0 means no ceiling.
+	MinBandwidth uint
+	MaxBandwidth uint
+	// MasterRefresh re-reads a live master playlist this often and switches
+	// variants if the selected one disappears (0 == never).
+	MasterRefresh time.Duration
+	// Lenient parses playlists leniently, skipping lines the parser does
+	// not understand instead of failing with ErrPlaylistDecode.
+	Lenient bool
+	// IFrame records the I-frame only variant instead.
+	IFrame bool
+	// AllVariants records every variant at once, each to its own file.
+	AllVariants bool
+	// MaxParallel caps the segments downloaded at the same time across all
+	// variants (0 == unlimited).
+	MaxParallel int
+	// AudioLang and SubLang also record these alternate renditions and
+	// mux them into the output with ffmpeg.
+	AudioLang string
+	SubLang   string
+	KeepTemp  bool
+
+	// BasicAuth is user:password. Without it, NetrcFile is searched for
+	// credentials of the host.
+	BasicAuth string
+	NetrcFile string
+	// TokenCommand prints an access token for the Authorization header.
+	// It is rerun when the server answers 401 or 403.
+	TokenCommand string
+
+	// TLS versions ("1.0" to "1.3") and comma separated cipher suite names.
+	TLSMinVersion string
+	TLSMaxVersion string
+	TLSCiphers    string
+	// HTTP3 tries HTTP/3 first. It needs a build with -tags http3.
+	HTTP3 bool
+	// Interface is a network interface name or source IP address to make
+	// connections from.
+	Interface string
+	// NoHappyEyeballs tries the addresses of a host one after the other
+	// instead of racing IPv6 and IPv4 connections.
+	NoHappyEyeballs bool
+	// ConnectTimeout limits how long opening a connection may take, apart
+	// from the time to transfer anything over it. 0 means 30 seconds.
+	ConnectTimeout time.Duration
+
+	// SegmentsDir also saves each segment there, named by sequence number
+	// ("seq", the default) or program-date-time ("pdt") per SegmentNames.
+	SegmentsDir  string
+	SegmentNames string
+	// DedupKey tells which live segments were downloaded already: by URI
+	// ("uri", the default) or by media sequence number and URI ("seq+uri"),
+	// for encoders that reuse URIs for new segments.
+	DedupKey string
+	// Skip leaves out this much media at the start of the playlist.
+	Skip time.Duration
+	// Since leaves out segments with a program-date-time before it.
+	Since time.Time
+	// RangeStart and RangeEnd only record the VOD segments overlapping this
+	// part of the timeline (RangeEnd 0 == to the end). RangeExact then cuts
+	// the output to the range with ffmpeg, which re-encodes it.
+	RangeStart time.Duration
+	RangeEnd   time.Duration
+	RangeExact bool
+	// NormalizeTimestamps remuxes the output with ffmpeg afterwards so its
+	// timestamps run on continuously across segments.
+	NormalizeTimestamps bool
+	// TrimEnd only records live segments at least this far behind the live
+	// edge.
+	TrimEnd time.Duration
+	// Refresh reloads live playlists this often instead of every target
+	// duration.
+	Refresh time.Duration
+	// Concurrency is the number of segments downloaded at the same time.
+	// Progressive keeps the downloads close to the start of the output.
+	Concurrency int
+	Progressive bool
+	// FollowVariantOnError falls back to the next best variant of the
+	// master playlist when the selected media playlist keeps failing.
+	FollowVariantOnError bool
+	// MaxInflightBytes caps the memory held by segments downloaded ahead of
+	// the one the output waits for (0 == unlimited).
+	MaxInflightBytes ByteSize
+	// AutoConcurrency adjusts the number of segments downloaded at the same
+	// time to the measured throughput, up to Concurrency or 16.
+	AutoConcurrency bool
+	// SegmentConnections splits each segment download into this many
+	// parallel range requests if the server supports them.
+	SegmentConnections int
+	// Retries is how often a segment is retried after a network error or an
+	// HTTP 429 or 5xx response.
+	Retries int
+	// Reconnect starts over from the playlist URL up to this many times
+	// when a live stream is lost while recording, e.g. its playlist
+	// disappears, and goes on appending to the output.
+	Reconnect int
+	// Mode is "auto" (the default) to tell live streams from VOD by their
+	// playlist, or "live" or "vod" to say which it is. Live streams get a
+	// stall timeout and reconnects unless set; "vod" records an open
+	// playlist as it is now and stops.
+	Mode string
+	// LiveDeadline gives up on a live segment instead of retrying it when
+	// it would have left the live playlist by the next attempt.
+	LiveDeadline bool
+	// MaxBackoff caps the doubling wait between segment retries and
+	// playlist reloads after errors (default 60s). A Retry-After header
+	// from the server is honored regardless.
+	MaxBackoff time.Duration
+	// RetryIfBodyMatches treats a segment whose first kilobyte matches as
+	// failed and retries it, for servers that answer 200 with an error page.
+	RetryIfBodyMatches *regexp.Regexp
+	// KeyQuery appends the query of the playlist URL, e.g. a signing
+	// token, to key URIs without a query of their own.
+	KeyQuery bool
+	// Verifier checks every segment and retries those it rejects, e.g. an
+	// MD5Sidecar.
+	Verifier SegmentVerifier
+	// Include and Exclude select segments by URI, e.g. to leave out ads.
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+	// SegmentCompression lets segment requests ask for gzip like playlist
+	// requests do.
+	SegmentCompression bool
+	// Precheck checks that all VOD segments exist with HEAD requests first.
+	Precheck bool
+	// MaxPlaylistSize fails on larger playlists rather than reading them
+	// into memory (0 == unlimited).
+	MaxPlaylistSize ByteSize
+	// MaxSegmentSize rejects larger segments (0 == unlimited).
+	MaxSegmentSize ByteSize
+	Rewrites       RewriteRules
+	// SegmentBase resolves relative segment URIs instead of the playlist
+	// URL, for playlists whose segments are stored elsewhere.
+	SegmentBase *url.URL
+
+	// Processing of MPEG-TS segments.
+	AppendPAT    bool
+	DedupContent bool
+	Demux        bool
+	OnlyAudio    bool
+	OnlyVideo    bool
+	// ValidateCC checks the MPEG-TS continuity counters of the output file
+	// when it is done and logs the errors per PID.
+	ValidateCC bool
+	// ExtractCaptions writes the CEA-608 captions in the video of MPEG-TS
+	// segments to <output>.vtt.
+	ExtractCaptions bool
+
+	// Sink is an http(s) URL to stream the output to instead of a local
+	// file, with SinkMethod PUT (the default) or POST.
+	Sink       string
+	SinkMethod string
+	// OutputFile is an open file, e.g. a descriptor inherited from a parent
+	// process, to write the output to instead. The output given to
+	// Download then only names it in messages. It is never closed.
+	OutputFile *os.File
+	// FlushInterval batches what is written to pipes, standard output and
+	// uploads for at least this long instead of flushing it after every
+	// segment.
+	FlushInterval time.Duration
+	// Tee also writes the recording to these destinations. A destination
+	// that fails is dropped unless TeeErrorsFatal, which fails the download.
+	Tee            Tees
+	TeeErrorsFatal bool
+	// SplitSize starts a new output file, out.1.ts, out.2.ts and so on, at
+	// the first segment boundary after this size (0 == off).
+	SplitSize ByteSize
+	// BufferMemory keeps the output in memory, up to this size, and only
+	// writes it when the download is done (0 == off).
+	BufferMemory ByteSize
+	// ChecksumManifest writes the SHA-256 of each segment to
+	// <output>.sha256.
+	ChecksumManifest bool
+	Resume           bool
+	Preallocate      bool
+	// Keystore keeps the fetched decryption keys in this file and uses them
+	// when the key server fails, e.g. when resuming an old download.
+	Keystore string
+	// AutoExt appends the extension of the detected format to the output
+	// name. It is always done when the output has no extension.
+	AutoExt bool
+	// StallTimeout fails the download with ErrStalled when the output does
+	// not grow for this long (0 == 2 minutes for live streams unless
+	// filtered, negative == never).
+	StallTimeout time.Duration
+	// MaxGap warns when the program date-times of consecutive live segments
+	// are further apart than this (0 == off), and with AbortOnGap fails the
+	// download with ErrGap.
+	MaxGap     time.Duration
+	AbortOnGap bool
+	// Trace collects per segment request timings and logs a summary.
+	Trace bool
+	// ReportTemplate is executed with a Report to ReportOutput when a
+	// download is done.
+	ReportTemplate *template.Template
+	ReportOutput   io.Writer
+	// AdMarkers writes the EXT-X-DATERANGE tags of the playlist, which mark
+	// ad breaks, to this file. SkipAds leaves out the segments within ad
+	// breaks of known length.
+	AdMarkers string
+	SkipAds   bool
+	// DumpHeaders appends the headers of every HTTP response to this file.
+	DumpHeaders string
+	// CacheDir keeps HTTP responses in this directory across runs and uses
+	// them while their cache headers allow. CacheAlways uses cached segments
+	// and keys regardless, for repeated downloads of a VOD.
+	CacheDir    string
+	CacheAlways bool
+
+	// FirstSegmentOnly only downloads the first segment of the playlist to
+	// a temporary file and logs its size and streams, as a health check.
+	// The output is not written. KeepTemp keeps the file.
+	FirstSegmentOnly bool
+	// ProbeDuration only downloads about this much media, reports the
+	// bitrate and the projected size of a recording and returns, without
+	// writing an output (0 == off).
+	ProbeDuration time.Duration
+
+	// Watch polls the URL every WatchInterval until it is live.
+	Watch         bool
+	WatchInterval time.Duration
+}
+
+// Downloader records streams with a fixed set of Options. It runs one
+// download at a time. The Options must not be changed after New.
+type Downloader struct {
+	Options
+
+	transport   *http.Transport
+	client      *http.Client
+	sink        sink
+	tees        []tee
+	credentials netrc
+	tokens      *tokenSource
+	conns       connStats
+	timings     timingStats
+	keys        keyCache
+	keystore    *keyStore
+	slots       chan struct{} // limits segment downloads across variants
+
+	// Per download state.
+	out          sink
+	autoExt      bool
+	resumeFrom   int64 // size of the existing output when resuming
+	goneSegments int64 // segments the server answered 404 or 410 for
+	mismatches   int64 // segments that do not match the manifest in Replay
+	liveWatch    int32 // whether detectMode started the stall watchdog
+	written      int64 // bytes written to the output, for -stall-timeout
+	stop         context.CancelFunc
+	mu           sync.Mutex
+	err          error
+
+	// Host and credentials given in the URL itself, and the host any
+	// credentials are sent to.
+	urlAuth  *url.URL
+	authHost string
+	headers  *headerLog // -dump-headers
+	report   *Report
+	markers  *markers
+	// Position of RangeStart in the first recorded segment.
+	rangeOffset time.Duration
+}
+
+// New validates opts and sets up the HTTP client.
+func New(opts Options) (*Downloader, error) {
+	if opts.MaxBandwidth != 0 && opts.MinBandwidth > opts.MaxBandwidth {
+		return nil, errors.New("Minimum bandwidth is above maximum bandwidth")
+	}
+	if opts.OnlyAudio && opts.OnlyVideo {
+		return nil, errors.New("-only-audio and -only-video are mutually exclusive")
+	}
+	if opts.SegmentNames == "" {
+		opts.SegmentNames = "seq"
+	}
+	if opts.SegmentNames != "seq" && opts.SegmentNames != "pdt" {
+		return nil, errors.New("Segment names must be seq or pdt")
+	}
+	if opts.DedupKey == "" {
+		opts.DedupKey = "uri"
+	}
+	if opts.DedupKey != "uri" && opts.DedupKey != "seq+uri" {
+		return nil, errors.New("-dedup-key must be uri or seq+uri")
+	}
+	renditions := opts.AudioLang != "" || opts.SubLang != ""
+	if renditions && (opts.Sink != "" || opts.OutputFile != nil) {
+		return nil, errors.New("-audio-lang and -sub-lang need a local output file to mux into")
+	}
+	if opts.OutputFile != nil && (opts.Sink != "" || opts.AllVariants) {
+		return nil, errors.New("-output-fd cannot be used with -sink or -all-variants")
+	}
+	if len(opts.Tee) > 0 && (renditions || opts.AllVariants) {
+		return nil, errors.New("-tee cannot be used with -audio-lang, -sub-lang or -all-variants")
+	}
+	if renditions && (opts.Resume || opts.SegmentsDir != "") {
+		return nil, errors.New("-resume and -segments-dir cannot be used with -audio-lang or -sub-lang")
+	}
+	if opts.Resume && (opts.OnlyAudio || opts.OnlyVideo || opts.AppendPAT || opts.DedupContent) {
+		return nil, errors.New("-resume cannot be used with -only-audio, -only-video, -append-ts-pat or -dedup-content, which change the segments as written")
+	}
+	if opts.AllVariants && (renditions || opts.Resume || opts.SegmentsDir != "") {
+		return nil, errors.New("-all-variants needs an output file and cannot be used with -audio-lang, -sub-lang, -resume or -segments-dir")
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = 1
+	}
+	if opts.Concurrency < 0 {
+		return nil, errors.New("Concurrency must be at least 1")
+	}
+	if opts.SegmentConnections < 0 {
+		return nil, errors.New("-segment-connections must not be negative")
+	}
+	if opts.MaxParallel < 0 {
+		return nil, errors.New("-max-parallel must not be negative")
+	}
+	if opts.TrimEnd < 0 {
+		return nil, errors.New("-trim-end must not be negative")
+	}
+	if opts.Refresh < 0 {
+		return nil, errors.New("Refresh interval must not be negative")
+	}
+	if opts.WatchInterval == 0 {
+		opts.WatchInterval = 30 * time.Second
+	}
+	if opts.WatchInterval < 0 {
+		return nil, errors.New("Watch interval must be positive")
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 60 * time.Second
+	}
+	if opts.MaxBackoff < 0 {
+		return nil, errors.New("-max-backoff must be positive")
+	}
+	if opts.FlushInterval < 0 {
+		return nil, errors.New("-flush-interval must not be negative")
+	}
+	if opts.Mode == "" {
+		opts.Mode = "auto"
+	}
+	if opts.Mode != "auto" && opts.Mode != "live" && opts.Mode != "vod" {
+		return nil, errors.New("-mode must be auto, live or vod")
+	}
+	if opts.Reconnect < 0 {
+		return nil, errors.New("-reconnect must not be negative")
+	}
+	if opts.ConnectTimeout == 0 {
+		opts.ConnectTimeout = 30 * time.Second
+	}
+	if opts.ConnectTimeout < 0 {
+		return nil, errors.New("-connect-timeout must be positive")
+	}
+	if opts.Retries < 0 {
+		return nil, errors.New("-retries must not be negative")
+	}
+	if opts.RangeStart < 0 || opts.RangeEnd < 0 || opts.RangeEnd != 0 && opts.RangeEnd <= opts.RangeStart {
+		return nil, errors.New("-range must be start:end with end after start")
+	}
+	if opts.RangeExact && (opts.Sink != "" || opts.OutputFile != nil || opts.SplitSize > 0) {
+		return nil, errors.New("-range-exact needs a single local output file")
+	}
+	if opts.NormalizeTimestamps && (opts.Sink != "" || opts.OutputFile != nil || opts.SplitSize > 0) {
+		return nil, errors.New("-normalize-timestamps needs a single local output file")
+	}
+	if opts.ProbeDuration < 0 {
+		return nil, errors.New("-probe-duration must not be negative")
+	}
+	if opts.MaxGap < 0 {
+		return nil, errors.New("-max-gap must not be negative")
+	}
+	if opts.QueueSize < 0 {
+		return nil, errors.New("Queue size must not be negative")
+	}
+	if opts.ReportTemplate != nil && opts.ReportOutput == nil {
+		opts.ReportOutput = os.Stdout
+	}
+	if opts.PlaylistAccept == "" {
+		opts.PlaylistAccept = DefaultPlaylistAccept
+	}
+	if opts.SinkMethod == "" {
+		opts.SinkMethod = "PUT"
+	}
+
+	d := &Downloader{
+		Options:   opts,
+		transport: http.DefaultTransport.(*http.Transport).Clone(),
+		timings:   timingStats{samples: map[string][]time.Duration{}},
+		keys:      keyCache{keys: map[string]*keyFetch{}},
+		stop:      func() {},
+	}
+	d.client = &http.Client{Transport: d.transport}
+
+	var err error
+	d.sink, err = d.newSink(opts.Sink, opts.SinkMethod)
+	if err != nil {
+		return nil, err
+	}
+	if opts.OutputFile != nil {
+		d.sink = fdSink{opts.OutputFile}
+	}
+	d.tees, err = d.newTees(opts.Tee)
+	if err != nil {
+		return nil, err
+	}
+	if opts.SegmentsDir != "" {
+		if err := os.MkdirAll(opts.SegmentsDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if opts.MaxParallel > 0 {
+		d.slots = make(chan struct{}, opts.MaxParallel)
+	}
+
+	tlsConfig, err := newTLSConfig(opts.TLSMinVersion, opts.TLSMaxVersion, opts.TLSCiphers)
+	if err != nil {
+		return nil, err
+	}
+	d.transport.TLSClientConfig = tlsConfig
+	if !opts.NoHappyEyeballs {
+		d.transport.DialContext = newHappyEyeballs(opts.ConnectTimeout).DialContext
+	} else {
+		d.transport.DialContext = (&net.Dialer{
+			Timeout:       opts.ConnectTimeout,
+			KeepAlive:     30 * time.Second,
+			FallbackDelay: -1,
+		}).DialContext
+	}
+	if opts.Interface != "" {
+		if err := bindInterface(d.transport, opts.Interface, opts.ConnectTimeout); err != nil {
+			return nil, err
+		}
+	}
+	if opts.HTTP3 {
+		if opts.Interface != "" {
+			return nil, errors.New("-interface cannot be used with -http3")
+		}
+		if !http3Supported {
+			return nil, errors.New("This build of gohls has no HTTP/3 support. Rebuild it with -tags http3.")
+		}
+		d.enableHTTP3()
+	}
+	if opts.CacheAlways && opts.CacheDir == "" {
+		return nil, errors.New("-cache-always needs -cache-dir")
+	}
+	if opts.CacheDir != "" {
+		if err := os.MkdirAll(opts.CacheDir, 0755); err != nil {
+			return nil, err
+		}
+		d.client.Transport = &cacheTransport{next: d.client.Transport, dir: opts.CacheDir, always: opts.CacheAlways}
+	}
+
+	if opts.BasicAuth == "" && opts.NetrcFile != "" {
+		d.credentials, err = loadNetrc(opts.NetrcFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.TokenCommand != "" {
+		d.tokens = &tokenSource{cmd: opts.TokenCommand}
+	}
+	if opts.Keystore != "" {
+		d.keystore, err = openKeyStore(opts.Keystore)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Download records the stream, playlist or DASH manifest at uri to output.
+// An output of "-" is standard output, unless the Options give a sink. The
+// returned errors wrap ErrHTTP, ErrPlaylistDecode, ErrAuth, ErrSegmentGone,
+// ErrStreamEnded or ErrStalled where those apply.
+func (d *Downloader) Download(ctx context.Context, uri, output string) error {
+	if output == "-" && d.AllVariants {
+		return errors.New("-all-variants writes one file per variant and needs an output file name, not standard output")
+	}
+	if output == "-" && (d.AudioLang != "" || d.SubLang != "") {
+		return errors.New("-audio-lang and -sub-lang need a local output file to mux into")
+	}
+	if output == "-" && d.RangeExact {
+		return errors.New("-range-exact needs a single local output file")
+	}
+	if output == "-" && d.Sink == "" && len(d.Tee) > 0 {
+		for _, dest := range d.Tee {
+			if dest == "-" {
+				return errors.New("-tee - writes to standard output, which is the output already")
+			}
+		}
+	}
+	if output == "-" && d.NormalizeTimestamps {
+		return errors.New("-normalize-timestamps needs a single local output file")
+	}
+
+	uri = d.takeURLCredentials(uri)
+	ctx, done, err := d.begin(ctx, uri, output)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if d.FirstSegmentOnly {
+		return d.checkFirstSegment(ctx, uri)
+	}
+	if d.ProbeDuration > 0 {
+		return d.probeBitrate(ctx, uri)
+	}
+
+	s := stream{uri, output}
+	// With -resume the file is meant to be picked up, however recently it
+	// was written.
+	if !d.Resume && downloadInProgress(s.localFile) {
+		log.Printf("Download in progress for %v.\n", &s)
+		return nil
+	}
+	d.resumeFrom = 0
+	if d.Resume {
+		if info, err := os.Stat(s.localFile); err == nil {
+			d.resumeFrom = info.Size()
+		}
+	}
+	if d.Watch && !d.waitForStream(ctx, s.URI, d.WatchInterval) {
+		return d.result()
+	}
+	if d.StallTimeout > 0 {
+		go d.watchStalls(ctx, d.StallTimeout)
+	}
+	d.autoExt = d.AutoExt
+	if _, ok := d.out.(fileSink); ok && filepath.Ext(s.localFile) == "" && !isFIFO(s.localFile) {
+		d.autoExt = true
+	}
+	if d.AllVariants {
+		d.recordAllVariants(ctx, s.URI, s.localFile)
+	} else if d.isDASH(ctx, s.URI) {
+		d.recordDASH(ctx, s.URI, s.localFile)
+	} else if d.AudioLang != "" || d.SubLang != "" {
+		// The renditions are muxed into the output file as named.
+		d.autoExt = false
+		renditions, err := d.planRenditions(ctx, s.URI)
+		if err != nil {
+			return err
+		}
+		d.recordRenditions(ctx, renditions, s.localFile)
+	} else if !d.downloadStream(ctx, &s) {
+		// getPlaylist closes dlc when done; downloadSegment still drains
+		// everything already queued before returning.
+		dlc := make(chan *segment, d.QueueSize)
+		d.rangeOffset = 0
+		if d.RangeExact || d.NormalizeTimestamps {
+			// ffmpeg rewrites the output as named.
+			d.autoExt = false
+		}
+		go d.getPlaylist(ctx, s.URI, dlc)
+		d.downloadSegment(ctx, s.localFile, dlc)
+		if d.NormalizeTimestamps && !d.failed() {
+			d.normalizeTimestamps(s.localFile)
+		}
+		if d.RangeExact && !d.failed() {
+			d.trimRange(s.localFile)
+		}
+	}
+	return d.result()
+}
+
+// begin resets the per download state. It returns the context of the
+// download and a function to call when the download is done, which also
+// writes the report.
+func (d *Downloader) begin(ctx context.Context, uri, output string) (context.Context, func(), error) {
+	var headers *headerLog
+	if d.DumpHeaders != "" {
+		var err error
+		headers, err = openHeaderLog(d.DumpHeaders)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	ctx, stop := context.WithCancel(ctx)
+	d.stop = stop
+	d.err = nil
+	atomic.StoreInt64(&d.goneSegments, 0)
+	atomic.StoreInt64(&d.mismatches, 0)
+	atomic.StoreInt32(&d.liveWatch, 0)
+	d.headers = headers
+	d.markers = newMarkers()
+	d.report = nil
+	if d.ReportTemplate != nil {
+		d.report = newReport(uri, output)
+	}
+	d.out = d.sink
+	if d.Sink == "" && d.OutputFile == nil && output == "-" {
+		d.out = stdoutSink{}
+	}
+	return ctx, func() {
+		if d.AdMarkers != "" {
+			if err := d.markers.write(d.AdMarkers); err != nil {
+				log.Printf("Could not write the ad markers. %v\n", err)
+			}
+		}
+		if d.report != nil {
+			d.writeReport(d.report, d.result())
+		}
+		stop()
+		if headers != nil {
+			headers.Close()
+			d.headers = nil
+		}
+	}, nil
+}
+
+// fail ends the download with err. Only the first error is kept.
+func (d *Downloader) fail(err error) {
+	d.mu.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.mu.Unlock()
+	d.stop()
+}
+
+func (d *Downloader) failed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err != nil
+}
+
+func (d *Downloader) result() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	if n := atomic.LoadInt64(&d.goneSegments); n > 0 {
+		return fmt.Errorf("%w: %v segments were not found on the server", ErrSegmentGone, n)
+	}
+	if n := atomic.LoadInt64(&d.mismatches); n > 0 {
+		return fmt.Errorf("%v segments did not match the manifest", n)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+//go:build http3
+
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "log"
+import "net/http"
+import "sync"
+import "github.com/quic-go/quic-go"
+import "github.com/quic-go/quic-go/http3"
+
+const http3Supported = true
+
+// fallbackTransport tries HTTP/3 first and falls back to the regular
+// HTTP/1.1 and HTTP/2 transport for hosts where the QUIC handshake fails.
+type fallbackTransport struct {
+	h3       *http3.Transport
+	fallback http.RoundTripper
+	mu       sync.Mutex
+	failed   map[string]bool
+}
+
+func (t *fallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	failed := t.failed[req.URL.Host]
+	t.mu.Unlock()
+	if failed || req.URL.Scheme != "https" {
+		return t.fallback.RoundTrip(req)
+	}
+
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil || req.Context().Err() != nil {
+		return resp, err
+	}
+	log.Printf("HTTP/3 failed for %v, falling back to HTTP/2. %v\n", req.URL.Host, err)
+	t.mu.Lock()
+	t.failed[req.URL.Host] = true
+	t.mu.Unlock()
+	return t.fallback.RoundTrip(req)
+}
+
+func (d *Downloader) enableHTTP3() {
+	d.client.Transport = &fallbackTransport{
+		h3: &http3.Transport{
+			TLSClientConfig: d.transport.TLSClientConfig,
+			QUICConfig:      &quic.Config{HandshakeIdleTimeout: d.ConnectTimeout},
+		},
+		fallback: d.client.Transport,
+		failed:   map[string]bool{},
+	}
+}
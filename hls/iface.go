@@ -0,0 +1,80 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "fmt"
+import "net"
+import "net/http"
+import "time"
+
+// sourceIP resolves -interface, either an IP address or the name of a
+// network interface whose first address (IPv4 preferred) is used.
+func sourceIP(spec string) (net.IP, error) {
+	if ip := net.ParseIP(spec); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither an IP address nor a network interface", spec)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var found net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if found == nil {
+			found = ipNet.IP
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("network interface %v has no usable address", spec)
+	}
+	return found, nil
+}
+
+// bindInterface makes all HTTP connections originate from the given
+// interface or source address.
+func bindInterface(transport *http.Transport, spec string, timeout time.Duration) error {
+	ip, err := sourceIP(spec)
+	if err != nil {
+		return err
+	}
+	local := &net.TCPAddr{IP: ip}
+	// Fail now rather than on the first request.
+	l, err := net.ListenTCP("tcp", local)
+	if err != nil {
+		return fmt.Errorf("cannot bind to %v: %v", ip, err)
+	}
+	l.Close()
+
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: local,
+	}
+	transport.DialContext = dialer.DialContext
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bufio"
+import "bytes"
+import "encoding/hex"
+import "fmt"
+import "os"
+import "strings"
+import "sync"
+
+// keyStore keeps the decryption keys fetched during downloads in the
+// -keystore file, so resuming an encrypted VOD works even once the key
+// server no longer hands them out. Each line holds a key in hex and its URI,
+// without the -key-query token. The file is as sensitive as the recordings,
+// so it is only ever created readable by its owner and refused if others can
+// read it.
+type keyStore struct {
+	mu   sync.Mutex
+	f    *os.File
+	keys map[string][]byte
+}
+
+func openKeyStore(fn string) (*keyStore, error) {
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !windows && info.Mode().Perm()&0077 != 0 {
+		f.Close()
+		return nil, fmt.Errorf("keystore %v can be read by other users; chmod 600 it", fn)
+	}
+
+	s := &keyStore{f: f, keys: map[string][]byte{}}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key, err := hex.DecodeString(fields[0])
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("keystore %v line %v: %v", fn, n, err)
+		}
+		s.keys[fields[1]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// get returns the stored key for uri, if any.
+func (s *keyStore) get(uri string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[uri]
+	return key, ok
+}
+
+// add stores key for uri unless it is stored already. A later entry for the
+// same URI replaces an earlier one.
+func (s *keyStore) add(uri string, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.keys[uri]; ok && bytes.Equal(old, key) {
+		return nil
+	}
+	if _, err := fmt.Fprintf(s.f, "%x %v\n", key, uri); err != nil {
+		return err
+	}
+	s.keys[uri] = key
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "path/filepath"
+import "strings"
+import "testing"
+
+func TestKeystoreKeyQuery(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXTINF:4.0,
+0.ts
+#EXT-X-ENDLIST
+`
+	files := serveFiles(map[string]string{
+		"/p.m3u8": playlist,
+		"/0.ts":   encrypt(testKey, sequenceIV(7), []byte("segment")),
+	})
+	// The key is only handed out with the token of the first session.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/key.bin" {
+			files(w, r)
+		} else if r.URL.Query().Get("token") == "1" {
+			w.Write(testKey)
+		} else {
+			http.Error(w, "expired", http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	keystore := filepath.Join(t.TempDir(), "keys")
+	opts := Options{KeyQuery: true, Keystore: keystore}
+	for _, token := range []string{"1", "2"} {
+		data, err := record(t, opts, srv.URL+"/p.m3u8?token="+token)
+		if err != nil {
+			t.Fatalf("token %v: %v", token, err)
+		}
+		if string(data) != "segment" {
+			t.Errorf("token %v: got %q, want %q", token, data, "segment")
+		}
+	}
+	stored, _ := ioutil.ReadFile(keystore)
+	if want := srv.URL + "/key.bin\n"; !strings.HasSuffix(string(stored), want) || strings.Count(string(stored), "\n") != 1 {
+		t.Errorf("keystore holds %q, want one key for %v", stored, want)
+	}
+}
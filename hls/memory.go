@@ -0,0 +1,73 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bytes"
+import "context"
+import "io"
+import "log"
+
+// memoryOutput keeps a short recording in memory and only opens the sink
+// when it is done, so a failed download leaves no partial file behind. If
+// the recording outgrows the limit, it is written to the sink from then on.
+type memoryOutput struct {
+	ctx   context.Context
+	d     *Downloader
+	name  string
+	limit int64
+	buf   bytes.Buffer
+	dst   io.WriteCloser // set once written to the sink
+}
+
+func (m *memoryOutput) Write(b []byte) (int, error) {
+	if m.dst != nil {
+		return m.dst.Write(b)
+	}
+	if int64(m.buf.Len()+len(b)) <= m.limit {
+		return m.buf.Write(b)
+	}
+	log.Printf("The output is over -buffer-memory. Writing %v as it downloads.\n", m.name)
+	if err := m.spill(); err != nil {
+		return 0, err
+	}
+	return m.dst.Write(b)
+}
+
+// spill opens the sink and writes the buffered output to it.
+func (m *memoryOutput) spill() error {
+	dst, err := m.d.openSink(m.ctx, m.name)
+	if err != nil {
+		return err
+	}
+	m.dst = dst
+	_, err = m.buf.WriteTo(dst)
+	return err
+}
+
+func (m *memoryOutput) Close() error {
+	if m.dst == nil {
+		if m.d.failed() {
+			log.Printf("Discarding %v kb of buffered output after the error.\n", m.buf.Len()/1000)
+			return nil
+		}
+		if err := m.spill(); err != nil {
+			return err
+		}
+	}
+	return m.dst.Close()
+}
@@ -0,0 +1,79 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "log"
+import "sync/atomic"
+import "time"
+import "github.com/kz26/m3u8"
+
+// What live streams get with Mode auto or live unless the options set them.
+const (
+	liveStallTimeout = 2 * time.Minute
+	liveReconnects   = 3
+)
+
+// detectMode tells from the first media playlist of a download whether it
+// is live or VOD, or takes Mode's word for it, and logs which. A live
+// stream gets the stall watchdog and reconnects unless they were set. It
+// returns how many reconnects to allow and whether it is a VOD, which gets
+// progress and an estimate of the time left.
+func (d *Downloader) detectMode(ctx context.Context, mpl *m3u8.MediaPlaylist) (int, bool) {
+	live := !mpl.Closed
+	how := "Detected"
+	if d.Mode != "auto" {
+		live = d.Mode == "live"
+		how = "-mode " + d.Mode + ":"
+	}
+	if !live {
+		durations := segmentDurations(mpl)
+		var total time.Duration
+		for _, v := range durations {
+			total += v
+		}
+		log.Printf("%v VOD with %v segments, %v.\n", how, len(durations), total)
+		return d.Reconnect, true
+	}
+	log.Printf("%v a live stream.\n", how)
+	// Variants and renditions recorded together share one watchdog.
+	if d.StallTimeout == 0 && atomic.CompareAndSwapInt32(&d.liveWatch, 0, 1) {
+		if timeout := d.defaultStallTimeout(); timeout > 0 {
+			log.Printf("Stopping if the output does not grow for %v; -stall-timeout changes this.\n", timeout)
+			go d.watchStalls(ctx, timeout)
+		} else {
+			log.Printf("Not stopping if the output does not grow, as -since, -include, -exclude or -skip-ads may hold it back for long; -stall-timeout sets a limit.\n")
+		}
+	}
+	if d.Reconnect == 0 {
+		log.Printf("Reconnecting up to %v times if the stream is lost; -reconnect changes this.\n", liveReconnects)
+		return liveReconnects, false
+	}
+	return d.Reconnect, false
+}
+
+// defaultStallTimeout returns the stall timeout live streams get without
+// -stall-timeout, or 0 for none. The output may rightly not grow for long
+// while waiting for -since, or while segments are left out by -include,
+// -exclude or -skip-ads, e.g. during an ad break.
+func (d *Downloader) defaultStallTimeout() time.Duration {
+	if !d.Since.IsZero() || d.Include != nil || d.Exclude != nil || d.SkipAds {
+		return 0
+	}
+	return liveStallTimeout
+}
@@ -0,0 +1,102 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bytes"
+import "log"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "regexp"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+
+func TestDefaultStallTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want time.Duration
+	}{
+		{"plain", Options{}, liveStallTimeout},
+		{"-since", Options{Since: time.Now().Add(time.Hour)}, 0},
+		{"-include", Options{Include: regexp.MustCompile(`hd`)}, 0},
+		{"-exclude", Options{Exclude: regexp.MustCompile(`ad`)}, 0},
+		{"-skip-ads", Options{SkipAds: true}, 0},
+	}
+	for _, tt := range tests {
+		d := &Downloader{Options: tt.opts}
+		if got := d.defaultStallTimeout(); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMode(t *testing.T) {
+	// Live until the third request; the first one only tells that it is a
+	// playlist.
+	open := strings.Replace(twoSegments, "#EXT-X-ENDLIST\n", "", 1)
+	const progress = "2/2 segments, ~"
+	const watchdog = "Stopping if the output does not grow"
+	tests := []struct {
+		name string
+		opts Options
+		want []string // logged
+		not  []string // not logged
+	}{
+		{"auto", Options{}, []string{"Detected a live stream.", watchdog}, []string{progress}},
+		{"-mode vod", Options{Mode: "vod"}, []string{"-mode vod: VOD with 2 segments", progress}, []string{watchdog}},
+		{"-stall-timeout -1s", Options{StallTimeout: -time.Second}, nil, []string{watchdog, "Not stopping"}},
+		{"-exclude", Options{Exclude: regexp.MustCompile(`ad\.ts`)}, []string{"Not stopping if the output does not grow"}, []string{watchdog}},
+	}
+	for _, tt := range tests {
+		var requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/p.m3u8":
+				if atomic.AddInt32(&requests, 1) <= 2 {
+					w.Write([]byte(open))
+				} else {
+					w.Write([]byte(twoSegments))
+				}
+			default:
+				w.Write([]byte(r.URL.Path))
+			}
+		}))
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+		tt.opts.Refresh = 10 * time.Millisecond
+		data, err := record(t, tt.opts, srv.URL+"/p.m3u8")
+		log.SetOutput(os.Stderr)
+		srv.Close()
+		if err != nil || string(data) != "/0.ts/1.ts" {
+			t.Errorf("%v: got %q, %v", tt.name, data, err)
+		}
+		for _, s := range tt.want {
+			if !strings.Contains(logged.String(), s) {
+				t.Errorf("%v: %q was not logged:\n%v", tt.name, s, logged.String())
+			}
+		}
+		for _, s := range tt.not {
+			if strings.Contains(logged.String(), s) {
+				t.Errorf("%v: %q was logged:\n%v", tt.name, s, logged.String())
+			}
+		}
+	}
+}
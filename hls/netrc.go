@@ -0,0 +1,180 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bufio"
+import "io"
+import "net/http"
+import "net/url"
+import "os"
+import "path/filepath"
+import "strings"
+
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+// netrc holds credentials by machine name. The "default" entry, if any, is
+// stored under the empty name.
+type netrc map[string]netrcEntry
+
+// parseNetrc reads the machine, default, login and password tokens of a
+// .netrc file, skipping macro definitions.
+func parseNetrc(r io.Reader) (netrc, error) {
+	n := netrc{}
+	scanner := bufio.NewScanner(r)
+	var tokens []string
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// A macro definition ends at an empty line.
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i, f := range fields {
+			if f == "macdef" {
+				fields = fields[:i]
+				inMacro = true
+				break
+			}
+		}
+		tokens = append(tokens, fields...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var machine *string
+	var entry netrcEntry
+	save := func() {
+		if machine != nil {
+			n[*machine] = entry
+		}
+	}
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+			return ""
+		}
+		switch tokens[i] {
+		case "machine":
+			save()
+			name := next()
+			machine, entry = &name, netrcEntry{}
+		case "default":
+			save()
+			name := ""
+			machine, entry = &name, netrcEntry{}
+		case "login":
+			entry.login = next()
+		case "password":
+			entry.password = next()
+		case "account":
+			next()
+		}
+	}
+	save()
+	return n, nil
+}
+
+func (n netrc) lookup(host string) (netrcEntry, bool) {
+	if e, ok := n[host]; ok {
+		return e, true
+	}
+	e, ok := n[""]
+	return e, ok
+}
+
+// NetrcPath returns $NETRC or ~/.netrc, the default Options.NetrcFile of
+// the gohls command.
+func NetrcPath() string {
+	if p := os.Getenv("NETRC"); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// loadNetrc reads credentials from fn. A missing file is not an error.
+func loadNetrc(fn string) (netrc, error) {
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseNetrc(f)
+}
+
+// takeURLCredentials removes user:password@ from uri, so it is not logged,
+// and keeps it for later requests to the same host. That host is also the
+// only one -user and .netrc credentials are sent to.
+func (d *Downloader) takeURLCredentials(uri string) string {
+	d.urlAuth, d.authHost = nil, ""
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	d.authHost = u.Host
+	if u.User == nil {
+		return uri
+	}
+	d.urlAuth = &url.URL{Host: u.Host, User: u.User}
+	u.User = nil
+	return u.String()
+}
+
+// setBasicAuth applies -user, credentials from the URL or else matching
+// .netrc credentials to req if it goes to the host of the downloaded URL.
+// Segment CDNs, key servers and sinks on other hosts do not get them.
+func (d *Downloader) setBasicAuth(req *http.Request) {
+	if req.URL.Host != d.authHost {
+		return
+	}
+	if d.BasicAuth != "" {
+		parts := strings.SplitN(d.BasicAuth, ":", 2)
+		password := ""
+		if len(parts) == 2 {
+			password = parts[1]
+		}
+		req.SetBasicAuth(parts[0], password)
+		return
+	}
+	if d.urlAuth != nil {
+		password, _ := d.urlAuth.User.Password()
+		req.SetBasicAuth(d.urlAuth.User.Username(), password)
+		return
+	}
+	if e, ok := d.credentials.lookup(req.URL.Hostname()); ok && e.login != "" {
+		req.SetBasicAuth(e.login, e.password)
+	}
+}
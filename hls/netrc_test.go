@@ -0,0 +1,103 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bytes"
+import "io/ioutil"
+import "log"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync/atomic"
+import "testing"
+
+func TestURLCredentials(t *testing.T) {
+	files := serveFiles(map[string]string{"/p.m3u8": twoSegments, "/0.ts": "zero", "/1.ts": "one"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "alice" || password != "s3cret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		files(w, r)
+	}))
+	defer srv.Close()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	uri := strings.Replace(srv.URL, "http://", "http://alice:s3cret@", 1) + "/p.m3u8"
+	data, err := record(t, Options{}, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "zeroone" {
+		t.Errorf("got %q, want %q", data, "zeroone")
+	}
+	if strings.Contains(logged.String(), "s3cret") {
+		t.Errorf("the password was logged:\n%v", logged.String())
+	}
+}
+
+func TestCredentialsScope(t *testing.T) {
+	// The segments are on a CDN, which must not see the credentials.
+	var leaked int32
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			atomic.StoreInt32(&leaked, 1)
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer cdn.Close()
+	playlist := strings.NewReplacer("0.ts", cdn.URL+"/0.ts", "1.ts", cdn.URL+"/1.ts").Replace(twoSegments)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(playlist))
+	}))
+	defer srv.Close()
+
+	netrcFile := filepath.Join(t.TempDir(), "netrc")
+	ioutil.WriteFile(netrcFile, []byte("default login bob password hunter2\n"), 0600)
+	tests := []struct {
+		name string
+		opts Options
+		uri  string
+	}{
+		{"-user", Options{BasicAuth: "alice:s3cret"}, srv.URL + "/p.m3u8"},
+		{".netrc", Options{NetrcFile: netrcFile}, srv.URL + "/p.m3u8"},
+		{"URL", Options{}, strings.Replace(srv.URL, "http://", "http://alice:s3cret@", 1) + "/p.m3u8"},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&leaked, 0)
+		data, err := record(t, tt.opts, tt.uri)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if string(data) != "/0.ts/1.ts" {
+			t.Errorf("%v: got %q", tt.name, data)
+		}
+		if atomic.LoadInt32(&leaked) != 0 {
+			t.Errorf("%v: the credentials were sent to the segment host", tt.name)
+		}
+	}
+}
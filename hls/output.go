@@ -0,0 +1,217 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "fmt"
+import "io"
+import "log"
+import "os"
+import "path/filepath"
+import "runtime"
+import "time"
+
+// Windows cannot rename a file that is open, and may not update its
+// modification time until it is closed.
+const windows = runtime.GOOS == "windows"
+
+// output is the sink segments are written to, along with the writers layered
+// on top of it.
+type output struct {
+	name  string
+	dst   io.WriteCloser
+	file  *os.File // set for local files
+	demux *tsDemuxer
+	capts *captionExtractor
+	fixer *patFixer
+	probe *streamProbe
+	w     io.Writer
+
+	memory   *memoryOutput // -buffer-memory
+	manifest *os.File      // -checksum-manifest
+	autoExt  bool
+	sniffed  bool   // whether -auto-ext looked at the first segment yet
+	renameTo string // name to rename to once closed
+	// validateCC checks the continuity counters of the file once closed.
+	validateCC bool
+	// flusher batches the writes to pipes and uploads per segment.
+	flusher *segmentFlusher
+}
+
+func (d *Downloader) openOutput(ctx context.Context, fn string) (*output, error) {
+	var out io.WriteCloser
+	var memory *memoryOutput
+	if d.BufferMemory > 0 {
+		memory = &memoryOutput{ctx: ctx, d: d, name: fn, limit: int64(d.BufferMemory)}
+		out = memory
+	} else {
+		var err error
+		out, err = d.openSink(ctx, fn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	file := localFile(out)
+	var flusher *segmentFlusher
+	if memory == nil && (isStreaming(out) || len(d.tees) > 0) {
+		flusher = newSegmentFlusher(out, d.FlushInterval)
+		out = flusher
+	}
+
+	o := &output{name: fn, dst: out, w: &countingWriter{out, &d.written}, autoExt: d.autoExt, memory: memory, flusher: flusher}
+	o.file = file
+	if _, local := d.out.(fileSink); local && d.ValidateCC {
+		o.validateCC = true
+	}
+	if d.Demux {
+		o.demux = newTSDemuxer(fn)
+		o.w = io.MultiWriter(o.w, o.demux)
+	}
+	if d.AppendPAT {
+		o.fixer = newPATFixer(o.w)
+		o.w = o.fixer
+	}
+	if d.OnlyAudio {
+		o.w = newPIDFilter(o.w, isAudioStreamType)
+	} else if d.OnlyVideo {
+		o.w = newPIDFilter(o.w, isVideoStreamType)
+	}
+	if d.ChecksumManifest {
+		var err error
+		o.manifest, err = os.OpenFile(fn+".sha256", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+	}
+	o.probe = &streamProbe{}
+	o.w = io.MultiWriter(o.w, o.probe)
+	if d.ExtractCaptions {
+		// Before -only-audio can drop the video carrying them.
+		o.capts = newCaptionExtractor(fn + ".vtt")
+		o.w = io.MultiWriter(o.w, o.capts)
+	}
+	return o, nil
+}
+
+func (o *output) startSegment(v *segment) {
+	o.probe.startSegment()
+	if o.fixer != nil {
+		o.fixer.startSegment(v.URI)
+	}
+}
+
+func (o *output) endSegment(v *segment) error {
+	if o.autoExt && !o.sniffed && (o.file != nil || o.memory != nil) {
+		o.sniffed = true
+		// The probe still holds the first bytes of the segment.
+		o.rename(withExtension(o.name, sniffExtension(o.probe.buf)))
+	}
+	o.probe.endSegment(v)
+	if err := o.addToManifest(v, false); err != nil {
+		return err
+	}
+	if o.fixer != nil {
+		if err := o.fixer.endSegment(); err != nil {
+			return err
+		}
+	}
+	if o.flusher != nil {
+		if err := o.flusher.endSegment(); err != nil {
+			return err
+		}
+	}
+	if windows && o.file != nil {
+		// Keep downloadInProgress working for other instances.
+		now := time.Now()
+		os.Chtimes(o.name, now, now)
+	}
+	return nil
+}
+
+// addToManifest writes the -checksum-manifest line of a segment, or of an
+// initialization section if init.
+func (o *output) addToManifest(v *segment, init bool) error {
+	if o.manifest == nil || v.checksum == nil {
+		return nil
+	}
+	_, err := io.WriteString(o.manifest, manifestLine(v, init))
+	return err
+}
+
+// rename moves the output file to a new name while it is being written.
+func (o *output) rename(name string) {
+	if name == o.name {
+		return
+	}
+	if o.memory != nil && o.memory.dst == nil {
+		// Nothing was written to disk yet.
+		o.memory.name = name
+		o.name = name
+		return
+	}
+	if windows {
+		log.Printf("Renaming %v to %v when done.\n", o.name, name)
+		o.renameTo = name
+		return
+	}
+	if err := os.Rename(o.name, name); err != nil {
+		log.Printf("Could not rename %v to %v. %v\n", o.name, name, err)
+		return
+	}
+	log.Printf("Writing to %v.\n", name)
+	o.name = name
+}
+
+func (o *output) Close() error {
+	if o.demux != nil {
+		o.demux.Close()
+	}
+	if o.capts != nil {
+		o.capts.Close()
+	}
+	if o.manifest != nil {
+		o.manifest.Close()
+	}
+	if err := o.dst.Close(); err != nil {
+		log.Printf("Could not finish %v. %v\n", o.name, err)
+		return err
+	}
+	if o.renameTo != "" {
+		if err := os.Rename(o.name, o.renameTo); err != nil {
+			log.Printf("Could not rename %v to %v. %v\n", o.name, o.renameTo, err)
+			return err
+		}
+		o.name = o.renameTo
+	}
+	if o.validateCC {
+		validateContinuity(o.name)
+	}
+	return nil
+}
+
+// partName names the n-th part of a split output, e.g. out.2.ts. Part 0 is
+// the output file itself.
+func partName(fn string, n int) string {
+	if n == 0 {
+		return fn
+	}
+	ext := filepath.Ext(fn)
+	return fmt.Sprintf("%v.%v%v", fn[:len(fn)-len(ext)], n, ext)
+}
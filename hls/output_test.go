@@ -0,0 +1,88 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+// openTestOutput opens fn for writing like a download does.
+func openTestOutput(t *testing.T, fn string) *output {
+	t.Helper()
+	d, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.out = fileSink{}
+	o, err := d.openOutput(context.Background(), fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOutputAppend(t *testing.T) {
+	// Built with the separator of the platform, e.g. backslashes on Windows.
+	dir := filepath.Join(t.TempDir(), "sub dir")
+	os.Mkdir(dir, 0755)
+	fn := filepath.Join(dir, "out.ts")
+	if err := ioutil.WriteFile(fn, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	o := openTestOutput(t, fn)
+	o.w.Write([]byte("new"))
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(fn); string(data) != "oldnew" {
+		t.Errorf("got %q, want %q", data, "oldnew")
+	}
+}
+
+func TestOutputRenameOverExisting(t *testing.T) {
+	// rename moves the file right away where the platform allows it, and
+	// otherwise when it is closed, which the second case forces.
+	for _, deferred := range []bool{false, true} {
+		dir := t.TempDir()
+		fn, target := filepath.Join(dir, "out"), filepath.Join(dir, "out.ts")
+		if err := ioutil.WriteFile(target, []byte("stale"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		o := openTestOutput(t, fn)
+		o.w.Write([]byte("recording"))
+		if deferred {
+			o.renameTo = target
+		} else {
+			o.rename(target)
+		}
+		if err := o.Close(); err != nil {
+			t.Fatalf("deferred %v: %v", deferred, err)
+		}
+		if data, _ := ioutil.ReadFile(target); string(data) != "recording" {
+			t.Errorf("deferred %v: %v holds %q, want %q", deferred, target, data, "recording")
+		}
+		if _, err := os.Stat(fn); !os.IsNotExist(err) {
+			t.Errorf("deferred %v: %v is still there", deferred, fn)
+		}
+		if o.name != target {
+			t.Errorf("deferred %v: output named %v, want %v", deferred, o.name, target)
+		}
+	}
+}
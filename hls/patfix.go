@@ -0,0 +1,117 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "io"
+import "log"
+
+// Give up looking for the PAT/PMT after this many packets of a segment.
+const patSearchPackets = 64
+
+const nullPID = 0x1fff
+
+// patFixer makes sure every segment written through it starts with a PAT and
+// PMT, so the concatenated output can be decoded from any segment boundary.
+// It buffers the start of each segment until it has seen the tables or the
+// first media packet, then inserts the last tables seen if they are missing.
+type patFixer struct {
+	next      io.Writer
+	pmtPIDs   map[uint16]bool
+	pat       []byte
+	pmt       []byte
+	uri       string
+	buffering bool
+	buf       []byte
+	sawPAT    bool
+	sawPMT    bool
+}
+
+func newPATFixer(next io.Writer) *patFixer {
+	return &patFixer{next: next, pmtPIDs: map[uint16]bool{}}
+}
+
+func (f *patFixer) startSegment(uri string) {
+	f.uri = uri
+	f.buffering = true
+	f.buf = nil
+	f.sawPAT = false
+	f.sawPMT = false
+}
+
+func (f *patFixer) endSegment() error {
+	if f.buffering && len(f.buf) > 0 {
+		return f.flush()
+	}
+	f.buffering = false
+	return nil
+}
+
+func (f *patFixer) Write(b []byte) (int, error) {
+	if !f.buffering {
+		return f.next.Write(b)
+	}
+	f.buf = append(f.buf, b...)
+	if len(f.buf) > 0 && f.buf[0] != tsSyncByte {
+		// Not MPEG-TS, or not packet aligned; leave it alone.
+		log.Printf("%v does not start with a TS packet. Not checking for PAT/PMT.\n", f.uri)
+		f.sawPAT, f.sawPMT = true, true
+		return len(b), f.flush()
+	}
+	for i := 0; i+tsPacketSize <= len(f.buf); i += tsPacketSize {
+		p := tsPacket(f.buf[i : i+tsPacketSize])
+		pid := p.pid()
+		switch {
+		case pid == patPID:
+			f.sawPAT = true
+			f.pat = append([]byte(nil), p...)
+			for _, pmt := range parsePAT(psiSection(p.payload())) {
+				f.pmtPIDs[pmt] = true
+			}
+		case f.pmtPIDs[pid]:
+			f.sawPMT = true
+			f.pmt = append([]byte(nil), p...)
+		case pid != nullPID:
+			// Media data has started; the tables should have come first.
+			return len(b), f.flush()
+		}
+		if (f.sawPAT && f.sawPMT) || i/tsPacketSize >= patSearchPackets {
+			return len(b), f.flush()
+		}
+	}
+	return len(b), nil
+}
+
+func (f *patFixer) flush() error {
+	f.buffering = false
+	if !f.sawPAT || !f.sawPMT {
+		if f.pat != nil && f.pmt != nil {
+			log.Printf("%v does not start with a PAT/PMT. Inserting the previous ones.\n", f.uri)
+			if _, err := f.next.Write(f.pat); err != nil {
+				return err
+			}
+			if _, err := f.next.Write(f.pmt); err != nil {
+				return err
+			}
+		} else {
+			log.Printf("%v does not start with a PAT/PMT and none has been seen yet.\n", f.uri)
+		}
+	}
+	_, err := f.next.Write(f.buf)
+	f.buf = nil
+	return err
+}
@@ -0,0 +1,150 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "io"
+import "log"
+
+func isAudioStreamType(t byte) bool {
+	switch t {
+	case streamTypeMPEG1Audio, streamTypeMPEG2Audio, streamTypeAAC, 0x11, 0x81, 0x87:
+		return true
+	}
+	return false
+}
+
+func isVideoStreamType(t byte) bool {
+	switch t {
+	case 0x01, 0x02, streamTypeH264, streamTypeH265:
+		return true
+	}
+	return false
+}
+
+// pidFilter keeps only the audio or only the video elementary streams of the
+// MPEG-TS written to it. The PMT is rewritten to list just the kept streams.
+type pidFilter struct {
+	next    io.Writer
+	keep    func(byte) bool
+	pmtPIDs map[uint16]bool
+	pids    map[uint16]bool // PIDs of kept elementary streams
+	tsPacketizer
+}
+
+func newPIDFilter(next io.Writer, keep func(byte) bool) *pidFilter {
+	f := &pidFilter{
+		next:    next,
+		keep:    keep,
+		pmtPIDs: map[uint16]bool{},
+		pids:    map[uint16]bool{},
+	}
+	f.handle = f.packet
+	return f
+}
+
+func (f *pidFilter) packet(p tsPacket) error {
+	pid := p.pid()
+	switch {
+	case pid == patPID:
+		if p.unitStart() {
+			for _, pmt := range parsePAT(psiSection(p.payload())) {
+				f.pmtPIDs[pmt] = true
+			}
+		}
+	case f.pmtPIDs[pid]:
+		if p.unitStart() {
+			p = f.filterPMT(p)
+		}
+	case !f.pids[pid]:
+		return nil
+	}
+	_, err := f.next.Write(p)
+	return err
+}
+
+// filterPMT returns a copy of a PMT packet without the dropped streams.
+func (f *pidFilter) filterPMT(p tsPacket) tsPacket {
+	payload := p.payload()
+	section := psiSection(payload)
+	if len(section) < 12 {
+		return p
+	}
+	infoEnd := 12 + (int(section[10]&0x0f)<<8 | int(section[11]))
+	if infoEnd > len(section) {
+		return p
+	}
+
+	pcrPID := uint16(section[8]&0x1f)<<8 | uint16(section[9])
+	kept := append([]byte(nil), section[:infoEnd]...)
+	keptPCR := false
+	for i := infoEnd; i+5 <= len(section); {
+		end := i + 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4]))
+		if end > len(section) {
+			break
+		}
+		pid := uint16(section[i+1]&0x1f)<<8 | uint16(section[i+2])
+		if f.keep(section[i]) {
+			if !f.pids[pid] {
+				log.Printf("Keeping PID %v with stream type 0x%02x.\n", pid, section[i])
+			}
+			f.pids[pid] = true
+			keptPCR = keptPCR || pid == pcrPID
+			kept = append(kept, section[i:end]...)
+		} else {
+			delete(f.pids, pid)
+		}
+		i = end
+	}
+	if !keptPCR {
+		// The PCR travelled with a dropped stream.
+		kept[8] = kept[8]&0xe0 | nullPID>>8
+		kept[9] = nullPID & 0xff
+	}
+
+	// section_length covers everything after it, including the CRC.
+	length := len(kept) - 3 + 4
+	kept[1] = kept[1]&0xf0 | byte(length>>8)
+	kept[2] = byte(length)
+	crc := crc32MPEG(kept)
+	kept = append(kept, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	out := append(tsPacket(nil), p...)
+	start := len(p) - len(payload) + 1 + int(payload[0])
+	n := copy(out[start:], kept)
+	for i := start + n; i < len(out); i++ {
+		out[i] = 0xff
+	}
+	return out
+}
+
+// crc32MPEG is the CRC used by MPEG-TS PSI sections (polynomial 0x04c11db7,
+// not reflected, no final XOR).
+func crc32MPEG(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, c := range b {
+		crc ^= uint32(c) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,209 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "io"
+import "sync"
+import "time"
+
+// segmentSlot is a queued segment and the signal that it was downloaded.
+type segmentSlot struct {
+	index int
+	v     *segment
+	done  chan struct{}
+}
+
+// prefetcher downloads segments with several workers into memory and hands
+// them on in their original order.
+type prefetcher struct {
+	workers     int
+	progressive bool
+	tuner       *concurrencyTuner // -auto-concurrency
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*segmentSlot // not yet given to a worker
+	order   []*segmentSlot // not yet handed on
+	count   int
+	next    int // index of the segment the output waits for
+	closed  bool
+	limit   int // workers allowed to download at the same time
+	busy    int
+
+	// Bytes downloaded but not handed on yet, and the most that may be
+	// (0 == unlimited).
+	held    int64
+	maxHeld int64
+}
+
+// prefetchSegments downloads the segments queued on dlc with -concurrency
+// workers. The returned channel delivers them in order with their data.
+func (d *Downloader) prefetchSegments(ctx context.Context, dlc chan *segment) chan *segment {
+	p := &prefetcher{workers: d.Concurrency, progressive: d.Progressive, limit: d.Concurrency,
+		maxHeld: int64(d.MaxInflightBytes)}
+	if d.AutoConcurrency {
+		p.tuner = newConcurrencyTuner(d.Concurrency)
+		p.workers = p.tuner.max
+		p.limit = p.tuner.limit
+	}
+	p.cond = sync.NewCond(&p.mu)
+	out := make(chan *segment)
+
+	go func() {
+		for v := range dlc {
+			p.add(v)
+		}
+		p.close()
+	}()
+	for i := 0; i < p.workers; i++ {
+		go func() {
+			for s := p.take(); s != nil; s = p.take() {
+				start := time.Now()
+				s.v.data, s.v.fetched = d.fetchData(ctx, s.v)
+				p.finished(s.v, time.Now().Sub(start))
+				close(s.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(out)
+		for s := p.first(); s != nil; s = p.first() {
+			select {
+			case <-s.done:
+			case <-ctx.Done():
+				return
+			}
+			size := 0
+			if s.v.data != nil {
+				size = s.v.data.Len()
+			}
+			p.advance(s.index+1, size)
+			select {
+			case out <- s.v:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (p *prefetcher) add(v *segment) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &segmentSlot{index: p.count, v: v, done: make(chan struct{})}
+	p.count++
+	p.pending = append(p.pending, s)
+	p.order = append(p.order, s)
+	p.cond.Broadcast()
+}
+
+func (p *prefetcher) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// take returns the next segment to download, or nil when there are no more.
+// With -progressive, workers stay within a window after the segment the
+// output waits for, so the start of the output completes first instead of
+// bandwidth being spread over segments far ahead. Once -max-inflight-bytes
+// are held, only the segment the output waits for is started, so a slow
+// one cannot make the others pile up in memory.
+func (p *prefetcher) take() *segmentSlot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if len(p.pending) > 0 && p.busy < p.limit {
+			s := p.pending[0]
+			full := p.maxHeld > 0 && p.held >= p.maxHeld && s.index > p.next
+			if !full && (!p.progressive || s.index < p.next+2*p.limit) {
+				p.pending = p.pending[1:]
+				p.busy++
+				return s
+			}
+		} else if len(p.pending) == 0 && p.closed {
+			return nil
+		}
+		p.cond.Wait()
+	}
+}
+
+// finished frees the worker that downloaded v and lets the tuner adjust the
+// number of workers.
+func (p *prefetcher) finished(v *segment, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.busy--
+	if v.data != nil {
+		p.held += int64(v.data.Len())
+	}
+	if p.tuner != nil && v.fetched {
+		if n := p.tuner.add(int64(v.data.Len()), latency); n > 0 {
+			p.limit = n
+		}
+	}
+	p.cond.Broadcast()
+}
+
+// first returns the oldest segment not handed on yet, or nil when there are
+// no more.
+func (p *prefetcher) first() *segmentSlot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.order) == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if len(p.order) == 0 {
+		return nil
+	}
+	s := p.order[0]
+	p.order = p.order[1:]
+	return s
+}
+
+// advance records that the segments before next were handed on, freeing
+// the size bytes held for the last one.
+func (p *prefetcher) advance(next, size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next = next
+	p.held -= int64(size)
+	p.cond.Broadcast()
+}
+
+// fetchSegment writes a segment to w, from its prefetched data if it has
+// any.
+func (d *Downloader) fetchSegment(ctx context.Context, v *segment, w io.Writer) bool {
+	if v.data == nil {
+		return d.onDownload(ctx, v, w)
+	}
+	data := v.data
+	v.data = nil
+	defer putSegmentBuffer(data)
+	if !v.fetched {
+		return false
+	}
+	if _, err := data.WriteTo(w); err != nil {
+		d.writeFailed(err)
+		return false
+	}
+	return true
+}
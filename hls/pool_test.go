@@ -0,0 +1,78 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+
+func TestMaxInflightBytes(t *testing.T) {
+	const segments = 8
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n"
+	want := ""
+	for i := 0; i < segments; i++ {
+		playlist += fmt.Sprintf("#EXTINF:4.0,\n%v.ts\n", i)
+		want += fmt.Sprintf("segment %v ", i)
+	}
+	playlist += "#EXT-X-ENDLIST\n"
+
+	// Segments of 10 bytes, so that the limit is reached with one of them
+	// held. Only the other two workers, which may have started before that,
+	// get ahead of the straggler; without a limit all of them do.
+	tests := []struct {
+		maxInflight ByteSize
+		limited     bool
+	}{
+		{0, false},
+		{10, true},
+	}
+	for _, test := range tests {
+		var ahead, stalled int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/p.m3u8":
+				w.Write([]byte(playlist))
+			case r.URL.Path == "/0.ts":
+				// The straggler.
+				time.Sleep(200 * time.Millisecond)
+				atomic.StoreInt32(&stalled, atomic.LoadInt32(&ahead))
+				fmt.Fprintf(w, "segment 0 ")
+			case strings.HasSuffix(r.URL.Path, ".ts"):
+				atomic.AddInt32(&ahead, 1)
+				fmt.Fprintf(w, "segment %v ", strings.TrimSuffix(r.URL.Path[1:], ".ts"))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		data, err := record(t, Options{Concurrency: 3, MaxInflightBytes: test.maxInflight}, srv.URL+"/p.m3u8")
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("-max-inflight-bytes %v: got %q, want %q", test.maxInflight, data, want)
+		}
+		if n := atomic.LoadInt32(&stalled); test.limited != (n <= 2) {
+			t.Errorf("-max-inflight-bytes %v: %v segments downloaded behind a straggler", test.maxInflight, n)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "log"
+import "os"
+
+// preallocateOutput reserves disk space for the rest of an output file that
+// is expected to reach size bytes. The file size itself is left alone so
+// appends keep working. Failure only costs the optimisation.
+func preallocateOutput(f *os.File, size int64) {
+	info, err := f.Stat()
+	if err != nil {
+		log.Printf("Could not preallocate %v. %v\n", f.Name(), err)
+		return
+	}
+	if size <= info.Size() {
+		return
+	}
+	if err := fallocate(f, info.Size(), size-info.Size()); err != nil {
+		log.Printf("Could not preallocate %v. %v\n", f.Name(), err)
+		return
+	}
+	log.Printf("Preallocated %v kb for %v.\n", size/1000, f.Name())
+}
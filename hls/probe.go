@@ -0,0 +1,220 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "encoding/binary"
+import "fmt"
+import "log"
+import "strings"
+
+// Look for the PMT in this many bytes at the start of a segment.
+const probeBytes = 64 * tsPacketSize
+
+var streamTypeNames = map[byte]string{
+	0x01:                 "mpeg1video",
+	0x02:                 "mpeg2video",
+	streamTypeMPEG1Audio: "mp3",
+	streamTypeMPEG2Audio: "mp3",
+	streamTypeAAC:        "aac",
+	0x11:                 "aac-latm",
+	0x15:                 "id3",
+	streamTypeH264:       "h264",
+	streamTypeH265:       "hevc",
+	0x81:                 "ac3",
+	0x87:                 "eac3",
+}
+
+// Names of the fMP4 sample entries of common codecs.
+var sampleEntryNames = map[string]string{
+	"avc1": "h264",
+	"avc3": "h264",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"av01": "av1",
+	"vp09": "vp9",
+	"mp4a": "aac",
+	"ac-3": "ac3",
+	"ec-3": "eac3",
+	"Opus": "opus",
+	"fLaC": "flac",
+	"wvtt": "webvtt",
+	"stpp": "ttml",
+}
+
+// streamProbe finds the elementary streams of each segment, from the PMT of
+// MPEG-TS segments or the sample entries of an fMP4 initialization section
+// written before the segment, to tell when they change across a
+// discontinuity.
+type streamProbe struct {
+	buf     []byte
+	current []string // streams of the segment being written
+	last    []string // streams of the last segment that had a PMT or init section
+}
+
+func (p *streamProbe) startSegment() {
+	p.buf = nil
+	p.current = nil
+}
+
+func (p *streamProbe) Write(b []byte) (int, error) {
+	if p.current == nil && len(p.buf) < probeBytes {
+		// Segments are often written in one piece, which need not be
+		// copied whole.
+		head := b
+		if n := probeBytes - len(p.buf); len(head) > n {
+			head = head[:n]
+		}
+		p.buf = append(p.buf, head...)
+		p.current = findStreams(p.buf)
+	}
+	return len(b), nil
+}
+
+// endSegment warns if a discontinuity brought different streams, since the
+// concatenated output cannot be played as one stream then.
+func (p *streamProbe) endSegment(v *segment) {
+	p.buf = nil
+	if p.current == nil {
+		return
+	}
+	if v.discontinuity && p.last != nil && strings.Join(p.last, " ") != strings.Join(p.current, " ") {
+		log.Printf("Streams change from %v to %v at the discontinuity before %v.\n",
+			describeStreams(p.last), describeStreams(p.current), v.URI)
+		log.Print("The output will not play as a single stream; split it at this point, e.g. with -segments-dir.")
+	}
+	p.last = p.current
+}
+
+// findStreamTypes returns the stream types listed in the first PMT of a TS
+// segment, or nil if none was found.
+func findStreamTypes(b []byte) []byte {
+	pmtPIDs := map[uint16]bool{}
+	for i := 0; i+tsPacketSize <= len(b); i += tsPacketSize {
+		p := tsPacket(b[i : i+tsPacketSize])
+		if p[0] != tsSyncByte {
+			return nil
+		}
+		if !p.unitStart() {
+			continue
+		}
+		switch pid := p.pid(); {
+		case pid == patPID:
+			for _, pmt := range parsePAT(psiSection(p.payload())) {
+				pmtPIDs[pmt] = true
+			}
+		case pmtPIDs[pid]:
+			types := []byte{}
+			for _, s := range parsePMT(psiSection(p.payload())) {
+				types = append(types, s.streamType)
+			}
+			return types
+		}
+	}
+	return nil
+}
+
+// findStreams returns the names of the streams of a TS segment, or of an
+// fMP4 initialization section, or nil if neither was found.
+func findStreams(b []byte) []string {
+	if types := findStreamTypes(b); types != nil {
+		var names []string
+		for _, t := range types {
+			name, ok := streamTypeNames[t]
+			if !ok {
+				name = fmt.Sprintf("0x%02x", t)
+			}
+			names = append(names, name)
+		}
+		return names
+	}
+	return findSampleEntries(b)
+}
+
+// findSampleEntries returns the codecs of the tracks of an fMP4
+// initialization section from the sample entries in its moov box, or nil if
+// b does not start with a complete one.
+func findSampleEntries(b []byte) []string {
+	var names []string
+	eachBox(b, func(typ string, moov []byte) {
+		if typ != "moov" {
+			return
+		}
+		eachBox(moov, func(typ string, trak []byte) {
+			if typ != "trak" {
+				return
+			}
+			stsd := findBox(trak, "mdia", "minf", "stbl", "stsd")
+			// A full box header and the entry count precede the entries.
+			if len(stsd) < 8 {
+				return
+			}
+			eachBox(stsd[8:], func(entry string, _ []byte) {
+				name, ok := sampleEntryNames[entry]
+				if !ok {
+					name = strings.TrimSpace(entry)
+				}
+				names = append(names, name)
+			})
+		})
+	})
+	return names
+}
+
+// eachBox calls f with the type and payload of each complete MP4 box in b.
+func eachBox(b []byte, f func(typ string, payload []byte)) {
+	for len(b) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(b))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return
+			}
+			size = binary.BigEndian.Uint64(b[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(b)) {
+			return
+		}
+		f(string(b[4:8]), b[header:size])
+		b = b[size:]
+	}
+}
+
+// findBox returns the payload of the box at path inside b, or nil.
+func findBox(b []byte, path ...string) []byte {
+	for _, typ := range path {
+		var found []byte
+		eachBox(b, func(t string, payload []byte) {
+			if t == typ && found == nil {
+				found = payload
+			}
+		})
+		if found == nil {
+			return nil
+		}
+		b = found
+	}
+	return b
+}
+
+func describeStreams(names []string) string {
+	return "[" + strings.Join(names, " ") + "]"
+}
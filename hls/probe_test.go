@@ -0,0 +1,98 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bytes"
+import "encoding/binary"
+import "fmt"
+import "log"
+import "os"
+import "strings"
+import "testing"
+
+// box returns an MP4 box of type typ holding the given payloads.
+func box(typ string, payloads ...[]byte) []byte {
+	payload := bytes.Join(payloads, nil)
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+	copy(b[4:], typ)
+	return append(b, payload...)
+}
+
+// fmp4Init returns an initialization section with a track for each of the
+// given sample entries.
+func fmp4Init(entries ...string) []byte {
+	var traks [][]byte
+	for _, entry := range entries {
+		stsd := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+		stsd = append(stsd, box(entry, make([]byte, 16))...)
+		traks = append(traks, box("trak", box("tkhd", make([]byte, 84)),
+			box("mdia", box("mdhd", make([]byte, 24)), box("minf", box("stbl", box("stsd", stsd))))))
+	}
+	return append(box("ftyp", []byte("iso6")), box("moov", traks...)...)
+}
+
+func TestFindSampleEntries(t *testing.T) {
+	fragment := append(box("moof", make([]byte, 16)), box("mdat", make([]byte, 32))...)
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{fmp4Init("avc1", "mp4a"), "[h264 aac]"},
+		{append(fmp4Init("hvc1", "ec-3"), fragment...), "[hevc eac3]"},
+		{fmp4Init("xyz1"), "[xyz1]"},
+		// A fragment or a cut off init section tells nothing.
+		{fragment, "[]"},
+		{fmp4Init("avc1")[:60], "[]"},
+	}
+	for i, tt := range tests {
+		if got := describeStreams(findStreams(tt.data)); got != tt.want {
+			t.Errorf("%v: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestStreamProbeFMP4(t *testing.T) {
+	fragment := append(box("moof", make([]byte, 16)), box("mdat", make([]byte, 32))...)
+	segments := []struct {
+		init          []byte
+		discontinuity bool
+	}{
+		{fmp4Init("avc1", "mp4a"), false},
+		{nil, false},
+		// The same codecs after a discontinuity.
+		{fmp4Init("avc1", "mp4a"), true},
+		{nil, true},
+		{fmp4Init("hvc1", "mp4a"), true},
+	}
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	p := &streamProbe{}
+	for i, s := range segments {
+		p.startSegment()
+		if s.init != nil {
+			p.Write(s.init)
+		}
+		p.Write(fragment)
+		p.endSegment(&segment{URI: fmt.Sprintf("%v.m4s", i), discontinuity: s.discontinuity})
+	}
+	if want := "Streams change from [h264 aac] to [hevc aac] at the discontinuity before 4.m4s."; !strings.Contains(logged.String(), want) || strings.Count(logged.String(), "Streams change") != 1 {
+		t.Errorf("logged %q, want only %q", logged.String(), want)
+	}
+}
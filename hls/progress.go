@@ -0,0 +1,117 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "fmt"
+import "sync"
+import "time"
+
+// Weight given to the latest segment when smoothing the download rate.
+const rateSmoothing = 0.3
+
+// progress tracks a determinate (VOD) download so an ETA can be reported.
+type progress struct {
+	mu            sync.Mutex
+	total         int
+	totalDuration time.Duration
+	done          int
+	doneDuration  time.Duration
+	bytes         int64
+	totalBytes    int64   // known only after a precheck
+	rate          float64 // media seconds downloaded per wall-clock second
+	bandwidth     float64 // bytes per second
+}
+
+func newProgress(segments []time.Duration) *progress {
+	p := &progress{total: len(segments)}
+	for _, d := range segments {
+		p.totalDuration += d
+	}
+	return p
+}
+
+// skip removes a segment that will not be downloaded from the totals.
+func (p *progress) skip(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total--
+	p.totalDuration -= d
+}
+
+// add records a finished segment that took elapsed to download.
+func (p *progress) add(d time.Duration, written int64, elapsed time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.doneDuration += d
+	p.bytes += written
+
+	if elapsed <= 0 {
+		return
+	}
+	rate := d.Seconds() / elapsed.Seconds()
+	bandwidth := float64(written) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = rate
+		p.bandwidth = bandwidth
+	} else {
+		p.rate = rateSmoothing*rate + (1-rateSmoothing)*p.rate
+		p.bandwidth = rateSmoothing*bandwidth + (1-rateSmoothing)*p.bandwidth
+	}
+}
+
+// remaining estimates the time left from the remaining bytes, if known, or
+// else the remaining media duration and the recent download rate.
+func (p *progress) remaining() time.Duration {
+	if p.rate == 0 {
+		return 0
+	}
+	left := (p.totalDuration - p.doneDuration).Seconds() / p.rate
+	if p.totalBytes > 0 && p.bandwidth > 0 {
+		left = float64(p.totalBytes-p.bytes) / p.bandwidth
+	}
+	return time.Duration(left * float64(time.Second)).Round(time.Second)
+}
+
+// estimatedSize returns the precheck total, or extrapolates the final size
+// from the bytes per second of media downloaded so far.
+func (p *progress) estimatedSize() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.totalBytes > 0 {
+		return p.totalBytes
+	}
+	if p.doneDuration <= 0 {
+		return 0
+	}
+	return int64(float64(p.bytes) / p.doneDuration.Seconds() * p.totalDuration.Seconds())
+}
+
+// finished returns the number of segments downloaded so far.
+func (p *progress) finished() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done
+}
+
+func (p *progress) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return fmt.Sprintf("%v/%v segments, ~%v remaining (%v kb/s)",
+		p.done, p.total, p.remaining(), int64(p.bandwidth/1000))
+}
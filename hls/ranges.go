@@ -0,0 +1,119 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bytes"
+import "context"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptrace"
+
+// Segments smaller than this per connection are fetched with one request;
+// the extra round trips would cost more than they save.
+const minRangePart = 256 << 10
+
+// A ranged download is held in memory as a whole, so larger segments are
+// fetched with one request when -max-segment-size does not limit them.
+const maxRangedSize = 1 << 30
+
+// doRangedRequest fetches the resource of req over -segment-connections
+// parallel range requests and returns it as one 200 response. It falls back
+// to a single request when the server does not advertise Accept-Ranges, or
+// the size of the resource is unknown, too small to be worth splitting or
+// too large to hold, which the single request then rejects.
+func (d *Downloader) doRangedRequest(req *http.Request) (*http.Response, error) {
+	head := req.Clone(req.Context())
+	head.Method = "HEAD"
+	resp, err := d.doRequest(head)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	size := resp.ContentLength
+	maxSize := int64(d.MaxSegmentSize)
+	if maxSize == 0 {
+		maxSize = maxRangedSize
+	}
+	if resp.StatusCode != 200 || resp.Header.Get("Accept-Ranges") != "bytes" || size < 2*minRangePart || size > maxSize {
+		return d.doRequest(req)
+	}
+	n := int64(d.SegmentConnections)
+	if size/n < minRangePart {
+		n = size / minRangePart
+	}
+
+	// The parts share the connection statistics but not the per segment
+	// timings of req, which are not safe for concurrent use.
+	ctx, cancel := context.WithCancel(httptrace.WithClientTrace(context.Background(), d.conns.clientTrace()))
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-req.Context().Done():
+			cancel()
+		case <-done:
+		}
+	}()
+
+	data := make([]byte, size)
+	errs := make(chan error, n)
+	for i := int64(0); i < n; i++ {
+		from, to := i*size/n, (i+1)*size/n
+		go func() {
+			errs <- d.fetchRange(ctx, req, data[from:to], from)
+		}()
+	}
+	for i := int64(0); i < n; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			cancel()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Header:        resp.Header,
+		ContentLength: size,
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		Request:       req,
+	}, nil
+}
+
+// fetchRange reads the bytes of req's resource starting at from into part.
+func (d *Downloader) fetchRange(ctx context.Context, req *http.Request, part []byte, from int64) error {
+	r := req.Clone(ctx)
+	r.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", from, from+int64(len(part))-1))
+	resp, err := d.doRequest(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("received HTTP %v for part of %v", resp.StatusCode, req.URL)
+	}
+	if _, err := io.ReadFull(resp.Body, part); err != nil {
+		return fmt.Errorf("could not read part of %v: %v", req.URL, err)
+	}
+	return nil
+}
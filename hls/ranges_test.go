@@ -0,0 +1,75 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bytes"
+import "net/http"
+import "net/http/httptest"
+import "sync/atomic"
+import "testing"
+
+func TestRangedSegment(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 64<<10) // 1M
+	files := serveRanges(map[string]string{"/p.m3u8": twoSegments, "/0.ts": string(big), "/1.ts": "one"})
+	var ranged int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranged, 1)
+		}
+		files(w, r)
+	}))
+	defer srv.Close()
+
+	data, err := record(t, Options{SegmentConnections: 4}, srv.URL+"/p.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, append(big, "one"...)) {
+		t.Errorf("got %v bytes that do not match", len(data))
+	}
+	if ranged != 4 {
+		t.Errorf("made %v range requests, want 4", ranged)
+	}
+}
+
+func TestRangedSegmentTooLarge(t *testing.T) {
+	files := serveFiles(map[string]string{"/p.m3u8": twoSegments, "/0.ts": "zero", "/1.ts": "one"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			// Claims far more than it has, or than fits in memory.
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", "9000000000000000000")
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			t.Errorf("range request for %v", r.URL.Path)
+		}
+		files(w, r)
+	}))
+	defer srv.Close()
+
+	for _, maxSize := range []ByteSize{0, 1 << 20} {
+		data, err := record(t, Options{SegmentConnections: 4, MaxSegmentSize: maxSize}, srv.URL+"/p.m3u8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "zeroone" {
+			t.Errorf("-max-segment-size %v: got %q, want %q", &maxSize, data, "zeroone")
+		}
+	}
+}
@@ -0,0 +1,180 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "fmt"
+import "log"
+import "net/url"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strings"
+import "sync"
+import "github.com/kz26/m3u8"
+
+// rendition is one media playlist recorded to a temporary file before the
+// renditions are muxed together.
+type rendition struct {
+	kind string // "video", "audio" or "subtitles"
+	URI  string
+	lang string
+	file string
+}
+
+// matchLang reports whether an EXT-X-MEDIA language matches the requested
+// one, so that "en" selects "en-US" too.
+func matchLang(have, want string) bool {
+	have = strings.ToLower(have)
+	want = strings.ToLower(want)
+	return have == want || strings.HasPrefix(have, want+"-")
+}
+
+func findRendition(variant *m3u8.Variant, typ, group, lang string) *m3u8.Alternative {
+	for _, alt := range variant.Alternatives {
+		if alt != nil && alt.Type == typ && alt.GroupId == group && matchLang(alt.Language, lang) {
+			return alt
+		}
+	}
+	return nil
+}
+
+// planRenditions selects the video variant of a master playlist plus the
+// audio and subtitle renditions in the requested languages.
+func (d *Downloader) planRenditions(ctx context.Context, masterURI string) ([]*rendition, error) {
+	masterURL, err := url.Parse(masterURI)
+	if err != nil {
+		return nil, err
+	}
+	mpl, baseURL, err := d.fetchMaster(ctx, masterURL)
+	if err != nil {
+		return nil, fmt.Errorf("-audio-lang and -sub-lang need a master playlist: %w", err)
+	}
+	variant, err := d.selectVariant(mpl)
+	if err != nil {
+		return nil, err
+	}
+	videoURL, err := baseURL.Parse(variant.URI)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Selected variant %v with bandwidth %v.\n", videoURL, variant.Bandwidth)
+	renditions := []*rendition{{kind: "video", URI: videoURL.String()}}
+
+	add := func(kind, typ, group, lang string) error {
+		alt := findRendition(variant, typ, group, lang)
+		if alt == nil {
+			return fmt.Errorf("no %v rendition in language %v", kind, lang)
+		}
+		if alt.URI == "" {
+			log.Printf("The %v rendition in language %v is part of the video stream.\n", kind, lang)
+			return nil
+		}
+		u, err := baseURL.Parse(alt.URI)
+		if err != nil {
+			return err
+		}
+		log.Printf("Selected %v rendition %v (%v).\n", kind, u, alt.Language)
+		renditions = append(renditions, &rendition{kind: kind, URI: u.String(), lang: alt.Language})
+		return nil
+	}
+	if d.AudioLang != "" {
+		if err := add("audio", "AUDIO", variant.Audio, d.AudioLang); err != nil {
+			return nil, err
+		}
+	}
+	if d.SubLang != "" {
+		if err := add("subtitles", "SUBTITLES", variant.Subtitles, d.SubLang); err != nil {
+			return nil, err
+		}
+	}
+	return renditions, nil
+}
+
+// recordRenditions downloads all renditions in parallel to temporary files
+// next to fn, then muxes them into fn with ffmpeg.
+func (d *Downloader) recordRenditions(ctx context.Context, renditions []*rendition, fn string) {
+	tmp, err := os.MkdirTemp(filepath.Dir(fn), "."+filepath.Base(fn)+"-")
+	if err != nil {
+		d.fail(err)
+		return
+	}
+	if d.KeepTemp {
+		log.Printf("Keeping temporary files in %v.\n", tmp)
+	} else {
+		defer os.RemoveAll(tmp)
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range renditions {
+		r.file = filepath.Join(tmp, r.kind)
+		wg.Add(1)
+		go func(r *rendition) {
+			defer wg.Done()
+			dlc := make(chan *segment, d.QueueSize)
+			go d.getPlaylist(ctx, r.URI, dlc)
+			d.downloadSegment(ctx, r.file, dlc)
+		}(r)
+	}
+	wg.Wait()
+	if d.failed() {
+		return
+	}
+
+	if err := muxRenditions(renditions, fn); err != nil {
+		d.fail(fmt.Errorf("Muxing renditions failed. %v", err))
+		return
+	}
+	log.Printf("Muxed %v renditions into %v.\n", len(renditions), fn)
+}
+
+func muxRenditions(renditions []*rendition, fn string) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y"}
+	for _, r := range renditions {
+		args = append(args, "-i", r.file)
+	}
+	hasAudio := false
+	for _, r := range renditions {
+		if r.kind == "audio" {
+			hasAudio = true
+		}
+	}
+	for i, r := range renditions {
+		switch {
+		case r.kind == "video" && hasAudio:
+			args = append(args, "-map", fmt.Sprintf("%v:v", i))
+		case r.kind == "video":
+			args = append(args, "-map", fmt.Sprint(i))
+		case r.kind == "audio":
+			args = append(args, "-map", fmt.Sprintf("%v:a", i), "-metadata:s:a:0", "language="+r.lang)
+		case r.kind == "subtitles":
+			args = append(args, "-map", fmt.Sprintf("%v:s", i), "-metadata:s:s:0", "language="+r.lang)
+		}
+	}
+	args = append(args, "-c", "copy")
+	if strings.EqualFold(filepath.Ext(fn), ".mp4") {
+		// MP4 cannot carry WebVTT as is.
+		args = append(args, "-c:s", "mov_text")
+	}
+	args = append(args, fn)
+
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
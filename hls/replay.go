@@ -0,0 +1,163 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bufio"
+import "context"
+import "crypto/aes"
+import "encoding/hex"
+import "fmt"
+import "log"
+import "os"
+import "strings"
+
+type manifestEntry struct {
+	checksum []byte
+	uri      string
+	init     bool // an EXT-X-MAP initialization section
+	// The EXT-X-BYTERANGE sub-range and the key, if any, to fetch the
+	// segment as it was.
+	rangeStart  int64
+	rangeLength int64
+	key         *segmentKey
+}
+
+// manifestLine formats the -checksum-manifest line of v: its checksum, size
+// and URI, followed by "init" for an initialization section,
+// "range=length@offset" for a sub-range and "key=URI iv=hex" for an
+// encrypted segment.
+func manifestLine(v *segment, init bool) string {
+	line := fmt.Sprintf("%x  %v  %v", v.checksum, v.size, v.URI)
+	if init {
+		line += "  init"
+	}
+	if v.rangeLength > 0 {
+		line += fmt.Sprintf("  range=%v@%v", v.rangeLength, v.rangeStart)
+	}
+	if v.key != nil {
+		line += fmt.Sprintf("  key=%v  iv=%x", v.key.uri, v.key.iv)
+	}
+	return line + "\n"
+}
+
+// readManifest reads a checksum manifest as written for -checksum-manifest,
+// one line per segment as formatted by manifestLine.
+func readManifest(fn string) ([]manifestEntry, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []manifestEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%v:%v: expected checksum, size and URI", fn, line)
+		}
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: invalid checksum: %v", fn, line, err)
+		}
+		e := manifestEntry{checksum: sum, uri: fields[2]}
+		if err := e.parseAttributes(fields[3:]); err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", fn, line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func (e *manifestEntry) parseAttributes(attrs []string) error {
+	var iv []byte
+	for _, attr := range attrs {
+		kv := strings.SplitN(attr, "=", 2)
+		var err error
+		switch {
+		case attr == "init":
+			e.init = true
+		case kv[0] == "range" && len(kv) == 2:
+			_, err = fmt.Sscanf(kv[1], "%d@%d", &e.rangeLength, &e.rangeStart)
+		case kv[0] == "key" && len(kv) == 2:
+			e.key = &segmentKey{uri: kv[1]}
+		case kv[0] == "iv" && len(kv) == 2:
+			iv, err = hex.DecodeString(kv[1])
+		default:
+			return fmt.Errorf("unknown attribute %q", attr)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %v: %v", attr, err)
+		}
+	}
+	if e.key != nil {
+		if len(iv) != aes.BlockSize {
+			return fmt.Errorf("key without a valid IV")
+		}
+		e.key.iv = iv
+	}
+	return nil
+}
+
+// Replay downloads the segments listed in a checksum manifest written with
+// ChecksumManifest to output again, without reading the playlist. Segments
+// that no longer match their checksum are left out and make it fail.
+func (d *Downloader) Replay(ctx context.Context, manifest, output string) error {
+	entries, err := readManifest(manifest)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("%v lists no segments", manifest)
+	}
+	ctx, done, err := d.begin(ctx, manifest, output)
+	if err != nil {
+		return err
+	}
+	defer done()
+	// Credentials go to the host of the segments.
+	d.takeURLCredentials(entries[0].uri)
+	if d.StallTimeout > 0 {
+		go d.watchStalls(ctx, d.StallTimeout)
+	}
+	d.autoExt = d.AutoExt
+	log.Printf("Replaying %v segments from %v.\n", len(entries), manifest)
+
+	dlc := make(chan *segment, d.QueueSize)
+	go func() {
+		defer close(dlc)
+		// An initialization section applies to the segments after it, as
+		// in the playlist.
+		var init *segment
+		for i, e := range entries {
+			v := &segment{URI: e.uri, seqNo: uint64(i), expected: e.checksum, rangeStart: e.rangeStart, rangeLength: e.rangeLength, key: e.key}
+			if e.init {
+				init = v
+				continue
+			}
+			v.init = init
+			if !send(ctx, dlc, v) {
+				return
+			}
+		}
+	}()
+	d.downloadSegment(ctx, output, dlc)
+	return d.result()
+}
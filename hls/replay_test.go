@@ -0,0 +1,121 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "crypto/sha256"
+import "fmt"
+import "io/ioutil"
+import "net/http/httptest"
+import "path/filepath"
+import "testing"
+
+// replay replays manifest to a file next to it and returns what was written.
+func replay(t *testing.T, manifest string) (string, error) {
+	t.Helper()
+	d, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(filepath.Dir(manifest), "copy.ts")
+	err = d.Replay(context.Background(), manifest, fn)
+	data, _ := ioutil.ReadFile(fn)
+	return string(data), err
+}
+
+func TestReplayEncrypted(t *testing.T) {
+	srv := httptest.NewServer(serveFiles(map[string]string{
+		"/p.m3u8": `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXTINF:4.0,
+0.ts
+#EXTINF:4.0,
+1.ts
+#EXT-X-ENDLIST
+`,
+		"/key.bin": string(testKey),
+		"/0.ts":    encrypt(testKey, sequenceIV(7), []byte("first segment")),
+		"/1.ts":    encrypt(testKey, sequenceIV(8), []byte("second segment")),
+	}))
+	defer srv.Close()
+
+	fn := filepath.Join(t.TempDir(), "out.ts")
+	want := "first segmentsecond segment"
+	data, err := recordTo(t, Options{ChecksumManifest: true}, srv.URL+"/p.m3u8", fn)
+	if err != nil || string(data) != want {
+		t.Fatalf("recorded %q, %v", data, err)
+	}
+	got, err := replay(t, fn+".sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestReplayFragmented(t *testing.T) {
+	srv := httptest.NewServer(serveRanges(map[string]string{"/all.mp4": "initfirstend"}))
+	defer srv.Close()
+
+	line := func(data, attrs string) string {
+		return fmt.Sprintf("%x  %v  %v/all.mp4  %v\n", sha256.Sum256([]byte(data)), len(data), srv.URL, attrs)
+	}
+	manifest := filepath.Join(t.TempDir(), "out.mp4.sha256")
+	err := ioutil.WriteFile(manifest, []byte(line("init", "init  range=4@0")+
+		line("first", "range=5@4")+line("end", "range=3@9")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := replay(t, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "initfirstend"; got != want {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestManifestLine(t *testing.T) {
+	v := &segment{
+		URI:         "http://example.com/all.ts",
+		checksum:    []byte{0xab, 0xcd},
+		size:        188,
+		rangeStart:  376,
+		rangeLength: 192,
+		key:         &segmentKey{uri: "http://example.com/key?token=1", iv: sequenceIV(9)},
+	}
+	line := manifestLine(v, true)
+	want := "abcd  188  http://example.com/all.ts  init  range=192@376  key=http://example.com/key?token=1  iv=00000000000000000000000000000009\n"
+	if line != want {
+		t.Fatalf("manifestLine = %q, want %q", line, want)
+	}
+
+	fn := filepath.Join(t.TempDir(), "out.ts.sha256")
+	ioutil.WriteFile(fn, []byte(line), 0644)
+	entries, err := readManifest(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := entries[0]
+	if !e.init || e.uri != v.URI || e.rangeStart != 376 || e.rangeLength != 192 || e.key == nil || e.key.uri != v.key.uri || string(e.key.iv) != string(v.key.iv) {
+		t.Errorf("readManifest gave %+v", e)
+	}
+}
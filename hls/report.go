@@ -0,0 +1,96 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "fmt"
+import "log"
+import "sync"
+import "time"
+
+// Report is what a ReportTemplate is executed with once a download is done.
+type Report struct {
+	URL      string
+	Output   string
+	Start    time.Time
+	End      time.Time
+	Elapsed  time.Duration
+	Segments []SegmentReport
+	// Totals over the segments written to the output.
+	Written  int
+	Bytes    int64
+	Duration time.Duration
+	Failed   int // segments left out after all retries
+	Error    string
+
+	mu sync.Mutex
+}
+
+// SegmentReport describes one segment of a Report.
+type SegmentReport struct {
+	URI       string
+	Sequence  uint64
+	Size      int64
+	Duration  time.Duration // of the media
+	Elapsed   time.Duration // to download it
+	Checksum  string        // SHA-256 with -checksum-manifest
+	OK        bool
+	Duplicate bool // left out by -dedup-content
+}
+
+func newReport(uri, output string) *Report {
+	return &Report{URL: uri, Output: output, Start: time.Now()}
+}
+
+func (r *Report) add(v *segment, ok, duplicate bool) {
+	s := SegmentReport{
+		URI:       v.URI,
+		Sequence:  v.seqNo,
+		Duration:  v.duration,
+		OK:        ok,
+		Duplicate: duplicate,
+	}
+	if ok {
+		s.Size, s.Elapsed = v.size, v.elapsed
+		if v.checksum != nil {
+			s.Checksum = fmt.Sprintf("%x", v.checksum)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Segments = append(r.Segments, s)
+	switch {
+	case !ok:
+		r.Failed++
+	case !duplicate:
+		r.Written++
+		r.Bytes += s.Size
+		r.Duration += s.Duration
+	}
+}
+
+// writeReport executes the ReportTemplate with the finished report.
+func (d *Downloader) writeReport(r *Report, err error) {
+	r.End = time.Now()
+	r.Elapsed = r.End.Sub(r.Start)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if terr := d.ReportTemplate.Execute(d.ReportOutput, r); terr != nil {
+		log.Printf("Could not write the report. %v\n", terr)
+	}
+}
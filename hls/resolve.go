@@ -0,0 +1,212 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "fmt"
+import "net/url"
+import "time"
+import "github.com/kz26/m3u8"
+
+// ResolveURL returns the URL of the media playlist or stream a download of
+// uri would record, after variant selection and redirects, without
+// downloading any segments. The returned errors wrap ErrHTTP, ErrAuth or
+// ErrPlaylistDecode where those apply.
+func (d *Downloader) ResolveURL(ctx context.Context, uri string) (string, error) {
+	_, final, err := d.resolvePlaylist(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	return final.String(), nil
+}
+
+// resolvePlaylist fetches the media playlist a download of uri would record,
+// going through a master playlist if need be. It returns the playlist and
+// its final URL after redirects, or a nil playlist if uri is a stream.
+func (d *Downloader) resolvePlaylist(ctx context.Context, uri string) (*m3u8.MediaPlaylist, *url.URL, error) {
+	uri = d.takeURLCredentials(uri)
+	for {
+		req, err := d.newRequest(ctx, "GET", uri, playlistRequest)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := d.doRequest(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		final := resp.Request.URL
+		if isStreamResponse(resp) {
+			resp.Body.Close()
+			return nil, final, nil
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, nil, playlistStatusError(resp.StatusCode, uri, false)
+		}
+		playlist, listType, err := d.decodePlaylist(resp.Body, uri)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if listType != m3u8.MASTER {
+			return playlist.(*m3u8.MediaPlaylist), final, nil
+		}
+		variant, err := d.selectVariant(playlist.(*m3u8.MasterPlaylist))
+		if err != nil {
+			return nil, nil, err
+		}
+		next, err := final.Parse(variant.URI)
+		if err != nil {
+			return nil, nil, err
+		}
+		if next.String() == uri {
+			return nil, nil, fmt.Errorf("%w: %v selects itself as a variant", ErrPlaylistDecode, uri)
+		}
+		uri = next.String()
+	}
+}
+
+// SegmentList is the media playlist a download would record, as returned by
+// ListSegments. Times are in seconds.
+type SegmentList struct {
+	URL            string          `json:"url"`
+	Live           bool            `json:"live"`
+	TargetDuration float64         `json:"target_duration"`
+	MediaSequence  uint64          `json:"media_sequence"`
+	Duration       float64         `json:"duration"`
+	Segments       []ListedSegment `json:"segments"`
+}
+
+// ListedSegment is one segment of a SegmentList.
+type ListedSegment struct {
+	URI             string     `json:"uri"`
+	Sequence        uint64     `json:"sequence"`
+	Start           float64    `json:"start"`
+	Duration        float64    `json:"duration"`
+	ProgramDateTime *time.Time `json:"program_date_time,omitempty"`
+	Discontinuity   bool       `json:"discontinuity,omitempty"`
+	ByteRange       *ByteRange `json:"byte_range,omitempty"`
+	Key             *ListedKey `json:"key,omitempty"`
+	Init            *ListedMap `json:"init,omitempty"`
+}
+
+// ByteRange is the EXT-X-BYTERANGE sub-range of a segment's resource.
+type ByteRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// ListedMap is the EXT-X-MAP initialization section of fragmented MP4
+// segments.
+type ListedMap struct {
+	URI       string     `json:"uri"`
+	ByteRange *ByteRange `json:"byte_range,omitempty"`
+}
+
+// ListedKey is the encryption of a segment. For AES-128 the IV is always
+// given, derived from the sequence number if the playlist has none.
+type ListedKey struct {
+	Method string `json:"method"`
+	URI    string `json:"uri"`
+	IV     string `json:"iv,omitempty"`
+}
+
+// ListSegments resolves uri like a download would and returns the segments
+// of the media playlist, with URIs resolved and rewritten and -include and
+// -exclude applied, without downloading them. For a live stream the list is a
+// snapshot of the current playlist. The returned errors are those of
+// ResolveURL.
+func (d *Downloader) ListSegments(ctx context.Context, uri string) (*SegmentList, error) {
+	mpl, base, err := d.resolvePlaylist(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	if mpl == nil {
+		return nil, fmt.Errorf("%w: %v is a stream, not a playlist", ErrPlaylistDecode, base)
+	}
+	list := &SegmentList{
+		URL:            base.String(),
+		Live:           !mpl.Closed,
+		TargetDuration: mpl.TargetDuration,
+		MediaSequence:  mpl.SeqNo,
+		Segments:       []ListedSegment{},
+	}
+	var cursor playlistCursor
+	for i, v := range mpl.Segments {
+		if v == nil {
+			continue
+		}
+		seg := cursor.next(v)
+		list.Duration = seg.end.Seconds()
+		msURI, err := d.segmentURI(base, v.URI)
+		if err != nil {
+			return nil, err
+		}
+		if !d.wanted(msURI) {
+			continue
+		}
+		ls := ListedSegment{
+			URI:           msURI,
+			Sequence:      mpl.SeqNo + uint64(i),
+			Start:         seg.start.Seconds(),
+			Duration:      seg.duration.Seconds(),
+			Discontinuity: v.Discontinuity,
+		}
+		if !seg.pdt.IsZero() {
+			pdt := seg.pdt
+			ls.ProgramDateTime = &pdt
+		}
+		if v.Limit > 0 {
+			ls.ByteRange = &ByteRange{Offset: seg.rangeStart, Length: v.Limit}
+		}
+		if ls.Key, err = d.listedKey(seg.key, base, ls.Sequence); err != nil {
+			return nil, err
+		}
+		if seg.xmap != nil {
+			initURI, err := d.segmentURI(base, seg.xmap.URI)
+			if err != nil {
+				return nil, err
+			}
+			ls.Init = &ListedMap{URI: initURI}
+			if seg.xmap.Limit > 0 {
+				ls.Init.ByteRange = &ByteRange{Offset: seg.xmap.Offset, Length: seg.xmap.Limit}
+			}
+		}
+		list.Segments = append(list.Segments, ls)
+	}
+	return list, nil
+}
+
+func (d *Downloader) listedKey(k *m3u8.Key, base *url.URL, seq uint64) (*ListedKey, error) {
+	if k == nil || k.Method == "" || k.Method == "NONE" {
+		return nil, nil
+	}
+	if k.Method == "AES-128" {
+		sk, err := d.newSegmentKey(k, base, seq)
+		if err != nil {
+			return nil, err
+		}
+		return &ListedKey{Method: k.Method, URI: sk.uri, IV: fmt.Sprintf("0x%x", sk.iv)}, nil
+	}
+	// Other methods are listed as given, for programs that support them.
+	keyURL, err := d.keyURL(base, k.URI)
+	if err != nil {
+		return nil, err
+	}
+	return &ListedKey{Method: k.Method, URI: keyURL.String(), IV: k.IV}, nil
+}
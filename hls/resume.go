@@ -0,0 +1,181 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "crypto/aes"
+import "crypto/cipher"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "log"
+import "net/http"
+import "net/url"
+import "github.com/kz26/m3u8"
+
+func (d *Downloader) headRequest(ctx context.Context, uri string, kind requestKind) (*http.Response, error) {
+	req, err := d.newRequest(ctx, "HEAD", uri, kind)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func (d *Downloader) acceptsRanges(ctx context.Context, uri string) bool {
+	resp, err := d.headRequest(ctx, uri, segmentRequest)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	return resp.StatusCode == 200 && resp.Header.Get("Accept-Ranges") == "bytes"
+}
+
+// resumePoint works out where an earlier download of a VOD playlist that
+// wrote size bytes stopped, from the sizes of its segments as written to the
+// output. It returns the index of the first segment still needed and how
+// many of its bytes are already in the output.
+func (d *Downloader) resumePoint(ctx context.Context, playlistURL *url.URL, mpl *m3u8.MediaPlaylist, size int64) (int, int64, bool) {
+	var done int64
+	var cursor playlistCursor
+	lastInit := ""
+	for i, v := range mpl.Segments {
+		if v == nil {
+			continue
+		}
+		seg := cursor.next(v)
+		key, err := d.newSegmentKey(seg.key, playlistURL, mpl.SeqNo+uint64(i))
+		if err != nil {
+			log.Printf("%v. Not resuming.\n", err)
+			return 0, 0, false
+		}
+		// Fragmented MP4 segments follow their initialization section,
+		// which is written again whenever it changes.
+		if seg.xmap != nil {
+			initKey := fmt.Sprintf("%v@%v+%v", seg.xmap.URI, seg.xmap.Offset, seg.xmap.Limit)
+			if initKey != lastInit {
+				lastInit = initKey
+				length, ok := d.writtenLength(ctx, playlistURL, seg.xmap.URI, seg.xmap.Offset, seg.xmap.Limit, key)
+				if !ok {
+					return 0, 0, false
+				}
+				if done+length > size {
+					log.Print("The output ends within an initialization section. Not resuming.")
+					return 0, 0, false
+				}
+				done += length
+			}
+		}
+		length, ok := d.writtenLength(ctx, playlistURL, v.URI, seg.rangeStart, v.Limit, key)
+		if !ok {
+			return 0, 0, false
+		}
+		if done+length > size {
+			return i, size - done, true
+		}
+		done += length
+	}
+	return len(mpl.Segments), 0, true
+}
+
+// writtenLength returns how many bytes the segment or sub-range uri refers
+// to takes up in the output: its size, asking the server if the playlist
+// does not give it, less the padding if it is encrypted with key.
+func (d *Downloader) writtenLength(ctx context.Context, playlistURL *url.URL, uri string, from, limit int64, key *segmentKey) (int64, bool) {
+	msURI, err := d.segmentURI(playlistURL, uri)
+	if err != nil {
+		log.Print(err)
+		return 0, false
+	}
+	length := limit
+	if length == 0 {
+		resp, err := d.headRequest(ctx, msURI, segmentRequest)
+		if err != nil || resp.StatusCode != 200 || resp.ContentLength < 0 {
+			log.Printf("Could not get the size of %v. Not resuming.\n", msURI)
+			return 0, false
+		}
+		length = resp.ContentLength - from
+	}
+	if key == nil {
+		return length, true
+	}
+	padding, err := d.paddingLength(ctx, msURI, from, length, key)
+	if err != nil {
+		log.Printf("Could not get the decrypted size of %v: %v. Not resuming.\n", msURI, err)
+		return 0, false
+	}
+	return length - padding, true
+}
+
+// paddingLength decrypts the last block of the encrypted resource at uri
+// from from to from+length to read the length of its PKCS#7 padding, which
+// the decrypted segment in the output goes without. In CBC mode, the block
+// before it serves as the IV.
+func (d *Downloader) paddingLength(ctx context.Context, uri string, from, length int64, k *segmentKey) (int64, error) {
+	if length < aes.BlockSize || length%aes.BlockSize != 0 {
+		return 0, fmt.Errorf("%v bytes is not a multiple of the block size", length)
+	}
+	start := from + length - 2*aes.BlockSize
+	if length == aes.BlockSize {
+		start = from
+	}
+	req, err := d.newRequest(ctx, "GET", uri, segmentRequest)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", start, from+length-1))
+	d.noCompression(req)
+	resp, err := d.doRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("received HTTP %v for its last block", resp.StatusCode)
+	}
+	tail, err := ioutil.ReadAll(io.LimitReader(resp.Body, 2*aes.BlockSize+1))
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(tail)) != from+length-start {
+		return 0, fmt.Errorf("received %v bytes for its last block", len(tail))
+	}
+	iv := k.iv
+	if len(tail) == 2*aes.BlockSize {
+		iv, tail = tail[:aes.BlockSize], tail[aes.BlockSize:]
+	}
+	key, err := d.fetchKey(ctx, k)
+	if err != nil {
+		return 0, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(tail, tail)
+	padding := int64(tail[aes.BlockSize-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return 0, errors.New("invalid padding")
+	}
+	return padding, nil
+}
@@ -0,0 +1,82 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bytes"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+// serveRanges answers like serveFiles, but with support for HEAD and range
+// requests.
+func serveRanges(files map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(body))
+	}
+}
+
+func TestResume(t *testing.T) {
+	segments := [][]byte{
+		bytes.Repeat([]byte("a"), 100),
+		bytes.Repeat([]byte("b"), 32), // padded with a whole block
+		bytes.Repeat([]byte("c"), 50),
+	}
+	want := string(bytes.Join(segments, nil))
+	plain := map[string]string{"/p.m3u8": threeSegments}
+	encrypted := map[string]string{
+		"/p.m3u8":  strings.Replace(threeSegments, "#EXTINF", "#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n#EXTINF", 1),
+		"/key.bin": string(testKey),
+	}
+	for i, seg := range segments {
+		name := "/" + string(rune('0'+i)) + ".ts"
+		plain[name] = string(seg)
+		encrypted[name] = encrypt(testKey, sequenceIV(uint64(i)), seg)
+	}
+
+	for name, files := range map[string]map[string]string{"plain": plain, "encrypted": encrypted} {
+		srv := httptest.NewServer(serveRanges(files))
+		for _, size := range []int{1, 99, 100, 101, 132, 133, 181, 182} {
+			fn := filepath.Join(t.TempDir(), "out.ts")
+			if err := ioutil.WriteFile(fn, []byte(want[:size]), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// Written just now, as when resuming right after an interruption.
+			data, err := recordTo(t, Options{Resume: true}, srv.URL+"/p.m3u8", fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != want {
+				t.Errorf("%v: resuming at %v bytes gave %q", name, size, data)
+			}
+		}
+		srv.Close()
+	}
+
+	if _, err := New(Options{Resume: true, OnlyAudio: true}); err == nil {
+		t.Error("-resume was accepted with -only-audio")
+	}
+}
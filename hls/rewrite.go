@@ -0,0 +1,59 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "fmt"
+import "regexp"
+import "strings"
+
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// RewriteRules is a repeatable flag of 'pattern=>replacement' rules applied
+// in order to segment URIs. Replacements may refer to capture groups as $1.
+type RewriteRules []rewriteRule
+
+func (r *RewriteRules) String() string {
+	var rules []string
+	for _, rule := range *r {
+		rules = append(rules, rule.pattern.String()+"=>"+rule.replacement)
+	}
+	return strings.Join(rules, ", ")
+}
+
+func (r *RewriteRules) Set(value string) error {
+	parts := strings.SplitN(value, "=>", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("rewrite rule %q is not of the form pattern=>replacement", value)
+	}
+	pattern, err := regexp.Compile(parts[0])
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rewriteRule{pattern, parts[1]})
+	return nil
+}
+
+func (r RewriteRules) apply(uri string) string {
+	for _, rule := range r {
+		uri = rule.pattern.ReplaceAllString(uri, rule.replacement)
+	}
+	return uri
+}
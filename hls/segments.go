@@ -0,0 +1,46 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "fmt"
+import "net/url"
+import "os"
+import "path"
+import "path/filepath"
+
+// Layout of program-date-time segment names. It sorts chronologically and
+// avoids characters that are awkward in file names.
+const pdtNameLayout = "20060102T150405.000Z"
+
+// segmentFileName names the file a segment is saved to in the segments
+// directory, by sequence number or by program-date-time when asked to and
+// the playlist has one.
+func segmentFileName(v *segment, names string) string {
+	ext := ".ts"
+	if u, err := url.Parse(v.URI); err == nil && path.Ext(u.Path) != "" {
+		ext = path.Ext(u.Path)
+	}
+	if names == "pdt" && !v.programDateTime.IsZero() {
+		return v.programDateTime.UTC().Format(pdtNameLayout) + ext
+	}
+	return fmt.Sprintf("%010d%v", v.seqNo, ext)
+}
+
+func (d *Downloader) createSegmentFile(v *segment) (*os.File, error) {
+	return os.Create(filepath.Join(d.SegmentsDir, segmentFileName(v, d.SegmentNames)))
+}
@@ -0,0 +1,134 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "fmt"
+import "io"
+import "net/http"
+import "net/url"
+import "os"
+import "path/filepath"
+import "strings"
+
+// sink opens the destination a recording is written to. name is the output
+// file given to Download, or a part of it when splitting. Opening may wait,
+// e.g. for the reader of a named pipe, until ctx is done.
+type sink interface {
+	open(ctx context.Context, name string) (io.WriteCloser, error)
+}
+
+// fileSink appends to local files.
+type fileSink struct{}
+
+func (fileSink) open(ctx context.Context, name string) (io.WriteCloser, error) {
+	if isFIFO(name) {
+		return openFIFO(ctx, name)
+	}
+	return os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+}
+
+// stdoutSink writes to standard output, selected with "-" as output file.
+type stdoutSink struct{}
+
+func (stdoutSink) open(ctx context.Context, name string) (io.WriteCloser, error) {
+	return nopWriteCloser{os.Stdout}, nil
+}
+
+// fdSink writes to a file opened by the caller, e.g. a descriptor passed
+// down by a supervisor. It stays open across parts and downloads; closing it
+// is up to the caller.
+type fdSink struct {
+	f *os.File
+}
+
+func (s fdSink) open(ctx context.Context, name string) (io.WriteCloser, error) {
+	return nopWriteCloser{s.f}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// httpSink streams the recording as the chunked body of a PUT or POST, e.g.
+// to a presigned object store URL. A {name} in the URL is replaced by the
+// base name of the output.
+type httpSink struct {
+	d      *Downloader
+	url    string
+	method string
+}
+
+func (d *Downloader) newSink(spec, method string) (sink, error) {
+	if spec == "" {
+		return fileSink{}, nil
+	}
+	if !strings.HasPrefix(spec, "http://") && !strings.HasPrefix(spec, "https://") {
+		return nil, fmt.Errorf("unsupported sink %v", spec)
+	}
+	if method != "PUT" && method != "POST" {
+		return nil, fmt.Errorf("sink method must be PUT or POST, not %v", method)
+	}
+	return httpSink{d, spec, method}, nil
+}
+
+func (s httpSink) open(ctx context.Context, name string) (io.WriteCloser, error) {
+	target := strings.Replace(s.url, "{name}", url.PathEscape(filepath.Base(name)), -1)
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(s.method, target, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", s.d.UserAgent)
+	s.d.setBasicAuth(req)
+
+	u := &upload{pw: pw, done: make(chan error, 1)}
+	go func() {
+		// The body cannot be replayed, so this skips doRequest's retries.
+		resp, err := s.d.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("sink %v returned HTTP %v", target, resp.StatusCode)
+			}
+		}
+		// Fail pending writes rather than blocking them forever.
+		pr.CloseWithError(err)
+		u.done <- err
+	}()
+	return u, nil
+}
+
+type upload struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (u *upload) Write(b []byte) (int, error) {
+	return u.pw.Write(b)
+}
+
+// Close ends the request body and waits for the server's response.
+func (u *upload) Close() error {
+	u.pw.Close()
+	return <-u.done
+}
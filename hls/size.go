@@ -0,0 +1,67 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "fmt"
+import "math"
+import "strconv"
+import "strings"
+
+// ByteSize is a flag holding a number of bytes, written with an optional
+// K, M or G suffix (powers of 1024), e.g. 512M.
+type ByteSize int64
+
+var sizeSuffixes = []struct {
+	suffix string
+	factor int64
+}{
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+func (b *ByteSize) String() string {
+	for _, s := range sizeSuffixes {
+		if *b != 0 && int64(*b)%s.factor == 0 {
+			return fmt.Sprintf("%v%v", int64(*b)/s.factor, s.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *ByteSize) Set(value string) error {
+	v := strings.ToUpper(strings.TrimSpace(value))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	factor := int64(1)
+	for _, s := range sizeSuffixes {
+		if strings.HasSuffix(v, s.suffix) {
+			factor = s.factor
+			v = strings.TrimSuffix(v, s.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	if n > math.MaxInt64/factor {
+		return fmt.Errorf("size %q is too large", value)
+	}
+	*b = ByteSize(n * factor)
+	return nil
+}
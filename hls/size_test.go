@@ -0,0 +1,50 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "testing"
+
+func TestByteSizeSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  ByteSize
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"1500", 1500, true},
+		{"64k", 64 << 10, true},
+		{"512M", 512 << 20, true},
+		{"2GiB", 2 << 30, true},
+		{"8589934591G", 8589934591 << 30, true},
+		{"8589934592G", 0, false},
+		{"99999999999G", 0, false},
+		{"-1M", 0, false},
+		{"1T", 0, false},
+	}
+	for _, tt := range tests {
+		var b ByteSize
+		err := b.Set(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("Set(%q) error = %v", tt.value, err)
+			continue
+		}
+		if tt.ok && b != tt.want {
+			t.Errorf("Set(%q) = %v, want %v", tt.value, int64(b), int64(tt.want))
+		}
+	}
+}
@@ -0,0 +1,63 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "fmt"
+import "io"
+import "sync/atomic"
+import "time"
+
+// countingWriter adds the bytes written through it to n.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// watchStalls fails the download with ErrStalled when nothing was written to
+// the output for timeout, e.g. because segments come back empty or a write
+// hangs.
+func (d *Downloader) watchStalls(ctx context.Context, timeout time.Duration) {
+	interval := timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := atomic.LoadInt64(&d.written)
+	grown := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n := atomic.LoadInt64(&d.written); n != last {
+			last, grown = n, time.Now()
+		} else if time.Since(grown) >= timeout {
+			d.fail(fmt.Errorf("%w: the output did not grow for %v", ErrStalled, timeout))
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "fmt"
+import "io"
+import "log"
+import "os"
+import "strings"
+
+// Tees is a repeatable flag of destinations the recording is also written
+// to besides the output: "-" for standard output, an http(s) URL to upload
+// it to like Sink, or a local file.
+type Tees []string
+
+func (t *Tees) String() string {
+	return strings.Join(*t, ", ")
+}
+
+func (t *Tees) Set(value string) error {
+	if value == "" {
+		return fmt.Errorf("empty -tee destination")
+	}
+	*t = append(*t, value)
+	return nil
+}
+
+// tee is an opened -tee destination.
+type tee struct {
+	dest string
+	sink sink
+}
+
+func (d *Downloader) newTees(dests Tees) ([]tee, error) {
+	var tees []tee
+	stdout := false
+	for _, dest := range dests {
+		switch {
+		case dest == "-":
+			if stdout {
+				return nil, fmt.Errorf("-tee - given twice")
+			}
+			stdout = true
+			tees = append(tees, tee{dest, stdoutSink{}})
+		case strings.HasPrefix(dest, "http://") || strings.HasPrefix(dest, "https://"):
+			s, err := d.newSink(dest, d.SinkMethod)
+			if err != nil {
+				return nil, err
+			}
+			tees = append(tees, tee{dest, s})
+		default:
+			tees = append(tees, tee{dest, fileSink{}})
+		}
+	}
+	return tees, nil
+}
+
+// openSink opens the output name and the -tee destinations along with it.
+func (d *Downloader) openSink(ctx context.Context, name string) (io.WriteCloser, error) {
+	out, err := d.out.open(ctx, name)
+	if err != nil || len(d.tees) == 0 {
+		return out, err
+	}
+	t := &teeWriter{WriteCloser: out, fatal: d.TeeErrorsFatal}
+	for _, dst := range d.tees {
+		// Files keep their name; uploads are named after the output, or
+		// the part of it being written.
+		teeName := name
+		if _, ok := dst.sink.(fileSink); ok {
+			teeName = dst.dest
+		}
+		w, err := dst.sink.open(ctx, teeName)
+		if err != nil {
+			if t.fatal {
+				t.Close()
+				return nil, fmt.Errorf("could not open -tee %v: %v", dst.dest, err)
+			}
+			log.Printf("Could not open -tee %v. Recording without it. %v\n", dst.dest, err)
+			continue
+		}
+		t.tees = append(t.tees, &teeDest{name: dst.dest, w: w})
+	}
+	return t, nil
+}
+
+// teeWriter writes to the output and copies everything to the -tee
+// destinations. Unless fatal, a destination that fails is dropped and the
+// others carry on.
+type teeWriter struct {
+	io.WriteCloser // the output
+	tees           []*teeDest
+	fatal          bool
+}
+
+type teeDest struct {
+	name   string
+	w      io.WriteCloser
+	failed bool
+}
+
+func (t *teeWriter) Write(b []byte) (int, error) {
+	n, err := t.WriteCloser.Write(b)
+	if err != nil {
+		return n, err
+	}
+	for _, dst := range t.tees {
+		if dst.failed {
+			continue
+		}
+		if _, err := dst.w.Write(b); err != nil {
+			dst.failed = true
+			// Closing an upload gives the reason it failed.
+			if e := dst.w.Close(); e != nil {
+				err = e
+			}
+			if t.fatal {
+				return n, fmt.Errorf("-tee %v: %v", dst.name, err)
+			}
+			log.Printf("Could not write to -tee %v. Recording without it. %v\n", dst.name, err)
+		}
+	}
+	return n, nil
+}
+
+func (t *teeWriter) Close() error {
+	err := t.WriteCloser.Close()
+	for _, dst := range t.tees {
+		if dst.failed {
+			continue
+		}
+		if e := dst.w.Close(); e != nil {
+			log.Printf("Could not finish -tee %v. %v\n", dst.name, e)
+			if t.fatal && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// localFile returns the local file w writes the output to, if any.
+func localFile(w io.Writer) *os.File {
+	if t, ok := w.(*teeWriter); ok {
+		w = t.WriteCloser
+	}
+	f, _ := w.(*os.File)
+	return f
+}
@@ -0,0 +1,36 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "fmt"
+import "log"
+
+// normalizeTimestamps remuxes fn with ffmpeg so its PTS and DTS run on
+// continuously where live segments reset or jump them. Only timestamps are
+// rewritten; the streams are copied as they are.
+func (d *Downloader) normalizeTimestamps(fn string) {
+	// ffmpeg shifts out any jump of more than a second between packets and
+	// starts the output at zero instead of the muxer's usual delay.
+	input := []string{"-fflags", "+genpts", "-dts_delta_threshold", "1"}
+	output := []string{"-c", "copy", "-muxdelay", "0", "-muxpreload", "0", "-avoid_negative_ts", "make_zero"}
+	if err := rewriteWithFFmpeg(fn, "normalizing", input, output); err != nil {
+		d.fail(fmt.Errorf("Normalizing the timestamps of %v failed. %v", fn, err))
+		return
+	}
+	log.Printf("Normalized the timestamps of %v.\n", fn)
+}
@@ -0,0 +1,85 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "crypto/tls"
+import "fmt"
+import "strings"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+	version, ok := tlsVersions[v]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", v)
+	}
+	return version, nil
+}
+
+// parseCipherSuites maps a comma separated list of cipher suite names, as
+// printed by crypto/tls, to their IDs. Insecure suites are accepted too since
+// the point is talking to servers that support nothing better.
+func parseCipherSuites(names string) ([]uint16, error) {
+	if names == "" {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[c.Name] = c.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// newTLSConfig builds the client TLS configuration. Empty values keep Go's
+// defaults.
+func newTLSConfig(minVersion, maxVersion, ciphers string) (*tls.Config, error) {
+	min, err := parseTLSVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	max, err := parseTLSVersion(maxVersion)
+	if err != nil {
+		return nil, err
+	}
+	if min != 0 && max != 0 && min > max {
+		return nil, fmt.Errorf("TLS min version %v is above max version %v", minVersion, maxVersion)
+	}
+	suites, err := parseCipherSuites(ciphers)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{MinVersion: min, MaxVersion: max, CipherSuites: suites}, nil
+}
@@ -0,0 +1,112 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "crypto/tls"
+import "fmt"
+import "net/http/httptrace"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+var timingPhases = []string{"dns", "connect", "tls", "ttfb", "transfer"}
+
+// segmentTiming records where the time went while fetching one segment.
+// Phases that did not happen, e.g. DNS on a reused connection, stay zero.
+type segmentTiming struct {
+	start     time.Time
+	dnsStart  time.Time
+	connStart time.Time
+	tlsStart  time.Time
+	firstByte time.Time
+	phases    map[string]time.Duration
+}
+
+func newSegmentTiming() *segmentTiming {
+	return &segmentTiming{start: time.Now(), phases: map[string]time.Duration{}}
+}
+
+func (t *segmentTiming) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.phases["dns"] = time.Now().Sub(t.dnsStart)
+		},
+		ConnectStart: func(string, string) { t.connStart = time.Now() },
+		ConnectDone: func(string, string, error) {
+			t.phases["connect"] = time.Now().Sub(t.connStart)
+		},
+		TLSHandshakeStart: func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.phases["tls"] = time.Now().Sub(t.tlsStart)
+		},
+		GotFirstResponseByte: func() {
+			t.firstByte = time.Now()
+			t.phases["ttfb"] = t.firstByte.Sub(t.start)
+		},
+	}
+}
+
+// done marks the end of the body transfer.
+func (t *segmentTiming) done() {
+	if !t.firstByte.IsZero() {
+		t.phases["transfer"] = time.Now().Sub(t.firstByte)
+	}
+}
+
+// timingStats aggregates segment timings for the end of run summary.
+type timingStats struct {
+	mu      sync.Mutex
+	samples map[string][]time.Duration
+}
+
+func (s *timingStats) add(t *segmentTiming) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for phase, d := range t.phases {
+		s.samples[phase] = append(s.samples[phase], d)
+	}
+}
+
+func (s *timingStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lines := []string{"Segment timings:"}
+	for _, phase := range timingPhases {
+		samples := s.samples[phase]
+		if len(samples) == 0 {
+			continue
+		}
+		sorted := append([]time.Duration(nil), samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		var total time.Duration
+		for _, d := range sorted {
+			total += d
+		}
+		lines = append(lines, fmt.Sprintf("%-8v n=%v min=%v avg=%v p50=%v p95=%v max=%v",
+			phase, len(sorted), sorted[0], total/time.Duration(len(sorted)),
+			percentile(sorted, 50), percentile(sorted, 95), sorted[len(sorted)-1]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)-1)*p/100]
+}
@@ -0,0 +1,60 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "fmt"
+import "log"
+import "os"
+import "os/exec"
+import "path/filepath"
+
+// trimRange cuts fn, which holds the segments overlapping -range, to the
+// exact range with ffmpeg. Cutting between key frames means re-encoding,
+// so this costs time and some quality.
+func (d *Downloader) trimRange(fn string) {
+	input := []string{"-ss", fmt.Sprint(d.rangeOffset.Seconds())}
+	var output []string
+	if d.RangeEnd > 0 {
+		output = []string{"-t", fmt.Sprint((d.RangeEnd - d.RangeStart).Seconds())}
+	}
+	if err := rewriteWithFFmpeg(fn, "trimming", input, output); err != nil {
+		d.fail(fmt.Errorf("Trimming %v failed. %v", fn, err))
+		return
+	}
+	log.Printf("Trimmed %v to the exact range.\n", fn)
+}
+
+// rewriteWithFFmpeg runs fn through ffmpeg with the given input and output
+// options into a temporary file named with tag, which then replaces fn.
+func rewriteWithFFmpeg(fn, tag string, input, output []string) error {
+	ext := filepath.Ext(fn)
+	tmp := fn[:len(fn)-len(ext)] + "." + tag + ext
+	args := append([]string{"-hide_banner", "-loglevel", "error", "-y"}, input...)
+	args = append(args, "-i", fn)
+	args = append(args, output...)
+	args = append(args, "-map", "0", tmp)
+
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
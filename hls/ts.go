@@ -0,0 +1,160 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+// Minimal MPEG-TS (ISO/IEC 13818-1) parsing, enough to find the programs and
+// elementary streams of a capture and to get at their PES payloads.
+
+const tsPacketSize = 188
+const tsSyncByte = 0x47
+
+const patPID = 0x0000
+
+// Elementary stream types from the PMT.
+const (
+	streamTypeMPEG1Audio = 0x03
+	streamTypeMPEG2Audio = 0x04
+	streamTypeAAC        = 0x0f
+	streamTypeH264       = 0x1b
+	streamTypeH265       = 0x24
+)
+
+type tsPacket []byte
+
+func (p tsPacket) pid() uint16 {
+	return uint16(p[1]&0x1f)<<8 | uint16(p[2])
+}
+
+func (p tsPacket) unitStart() bool {
+	return p[1]&0x40 != 0
+}
+
+func (p tsPacket) hasPayload() bool {
+	return p[3]&0x10 != 0
+}
+
+func (p tsPacket) continuity() byte {
+	return p[3] & 0x0f
+}
+
+// payload returns the packet payload after any adaptation field.
+func (p tsPacket) payload() []byte {
+	if !p.hasPayload() {
+		return nil
+	}
+	start := 4
+	if p[3]&0x20 != 0 {
+		start += 1 + int(p[4])
+	}
+	if start >= len(p) {
+		return nil
+	}
+	return p[start:]
+}
+
+// psiSection returns the table section of a PSI payload, skipping the pointer
+// field. Sections are assumed to fit in the packet that starts them.
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	start := 1 + int(payload[0])
+	if start+3 > len(payload) {
+		return nil
+	}
+	section := payload[start:]
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	if 3+length > len(section) || length < 4 {
+		return nil
+	}
+	// Drop the trailing CRC32.
+	return section[:3+length-4]
+}
+
+// parsePAT returns the PMT PIDs listed in a program association section.
+func parsePAT(section []byte) []uint16 {
+	var pids []uint16
+	for i := 8; i+4 <= len(section); i += 4 {
+		program := uint16(section[i])<<8 | uint16(section[i+1])
+		pid := uint16(section[i+2]&0x1f)<<8 | uint16(section[i+3])
+		if program != 0 {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+type tsStream struct {
+	pid        uint16
+	streamType byte
+}
+
+// parsePMT returns the elementary streams listed in a program map section.
+func parsePMT(section []byte) []tsStream {
+	if len(section) < 12 {
+		return nil
+	}
+	var streams []tsStream
+	i := 12 + (int(section[10]&0x0f)<<8 | int(section[11]))
+	for i+5 <= len(section) {
+		streams = append(streams, tsStream{
+			pid:        uint16(section[i+1]&0x1f)<<8 | uint16(section[i+2]),
+			streamType: section[i],
+		})
+		i += 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4]))
+	}
+	return streams
+}
+
+// pesPayload strips the PES header from the payload of a packet starting a
+// PES packet.
+func pesPayload(payload []byte) []byte {
+	if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return nil
+	}
+	start := 9 + int(payload[8])
+	if start > len(payload) {
+		return nil
+	}
+	return payload[start:]
+}
+
+// tsPacketizer splits a byte stream into TS packets, which may arrive split
+// across writes, and hands each one to handle.
+type tsPacketizer struct {
+	buf    []byte
+	handle func(tsPacket) error
+}
+
+func (t *tsPacketizer) Write(b []byte) (int, error) {
+	t.buf = append(t.buf, b...)
+	for len(t.buf) >= tsPacketSize {
+		if t.buf[0] != tsSyncByte {
+			// Resynchronise on the next sync byte.
+			t.buf = t.buf[1:]
+			continue
+		}
+		if err := t.handle(tsPacket(t.buf[:tsPacketSize])); err != nil {
+			return len(b), err
+		}
+		t.buf = t.buf[tsPacketSize:]
+	}
+	// Keep the partial packet in a fresh slice so buf does not grow forever.
+	t.buf = append([]byte(nil), t.buf...)
+	return len(b), nil
+}
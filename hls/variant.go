@@ -0,0 +1,191 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "fmt"
+import "log"
+import "net/url"
+import "github.com/kz26/m3u8"
+
+// selectVariant picks the highest bandwidth variant within -min-bandwidth
+// and -max-bandwidth. Only I-frame variants are considered with -iframe,
+// and never otherwise.
+func (d *Downloader) selectVariant(mpl *m3u8.MasterPlaylist) (*m3u8.Variant, error) {
+	min, max := d.MinBandwidth, d.MaxBandwidth
+	var best *m3u8.Variant
+	for _, v := range mpl.Variants {
+		if v == nil || v.Iframe != d.IFrame {
+			continue
+		}
+		bw := uint(v.Bandwidth)
+		if bw < min || (max != 0 && bw > max) {
+			continue
+		}
+		if best == nil || v.Bandwidth > best.Bandwidth {
+			best = v
+		}
+	}
+	if best == nil && d.IFrame {
+		return nil, fmt.Errorf("no I-frame variant with bandwidth between %v and %v", min, bandwidthLimit(max))
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no variant with bandwidth between %v and %v", min, bandwidthLimit(max))
+	}
+	return best, nil
+}
+
+func bandwidthLimit(max uint) string {
+	if max == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprint(max)
+}
+
+// fetchMaster loads the master playlist at masterURL. It also returns the URL
+// it was loaded from after redirects, which the URIs in it are relative to.
+func (d *Downloader) fetchMaster(ctx context.Context, masterURL *url.URL) (*m3u8.MasterPlaylist, *url.URL, error) {
+	req, err := d.newRequest(ctx, "GET", masterURL.String(), playlistRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := d.doRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("received HTTP %v for %v", resp.StatusCode, masterURL)
+	}
+	playlist, listType, err := d.decodePlaylist(resp.Body, masterURL.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	if listType != m3u8.MASTER {
+		return nil, nil, fmt.Errorf("%v is no longer a master playlist", masterURL)
+	}
+	baseURL := masterURL
+	if resp.Request != nil {
+		baseURL = resp.Request.URL
+	}
+	return playlist.(*m3u8.MasterPlaylist), baseURL, nil
+}
+
+// refreshVariant re-reads the master playlist and returns the URL of a newly
+// selected variant if the current one has disappeared, or nil to keep it.
+func (d *Downloader) refreshVariant(ctx context.Context, masterURL, current *url.URL) *url.URL {
+	mpl, baseURL, err := d.fetchMaster(ctx, masterURL)
+	if err != nil {
+		log.Printf("Could not refresh master playlist. %v\n", err)
+		return nil
+	}
+
+	found := false
+	for _, v := range mpl.Variants {
+		if v == nil {
+			continue
+		}
+		if u, err := baseURL.Parse(v.URI); err == nil && u.String() == current.String() {
+			found = true
+		}
+	}
+	if found {
+		return nil
+	}
+
+	variant, err := d.selectVariant(mpl)
+	if err != nil {
+		log.Printf("Variant %v disappeared from the master playlist and %v. Keeping it.\n", current, err)
+		return nil
+	}
+	next, err := baseURL.Parse(variant.URI)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	log.Printf("Variant %v disappeared from the master playlist. Switching to %v with bandwidth %v.\n",
+		current, next, variant.Bandwidth)
+	return next
+}
+
+// -follow-variant-on-error switches variants after this many playlist
+// errors in a row.
+const variantFailures = 3
+
+// variantFallback keeps the variants of the master playlist for
+// -follow-variant-on-error.
+type variantFallback struct {
+	master  *m3u8.MasterPlaylist
+	base    *url.URL
+	current *m3u8.Variant
+	tried   map[*m3u8.Variant]bool
+	errors  int // playlist errors in a row for the current variant
+}
+
+func newVariantFallback(master *m3u8.MasterPlaylist, base *url.URL, current *m3u8.Variant) *variantFallback {
+	return &variantFallback{master: master, base: base, current: current, tried: map[*m3u8.Variant]bool{current: true}}
+}
+
+// failed counts a playlist error and tells whether it is time to switch.
+func (f *variantFallback) failed() bool {
+	f.errors++
+	return f.errors >= variantFailures
+}
+
+// next picks the variant to fall back to: the highest bandwidth below the
+// current one, or failing that the lowest above it. It returns nil when
+// every variant was tried.
+func (f *variantFallback) next(iframe bool) *m3u8.Variant {
+	var below, above *m3u8.Variant
+	for _, v := range f.master.Variants {
+		if v == nil || v.Iframe != iframe || f.tried[v] {
+			continue
+		}
+		if v.Bandwidth < f.current.Bandwidth {
+			if below == nil || v.Bandwidth > below.Bandwidth {
+				below = v
+			}
+		} else if above == nil || v.Bandwidth < above.Bandwidth {
+			above = v
+		}
+	}
+	if below != nil {
+		return below
+	}
+	return above
+}
+
+// switchVariant gives up on the current variant for the reason given and
+// returns the URL of the next one, or nil if there is none left.
+func (d *Downloader) switchVariant(f *variantFallback, reason string) *url.URL {
+	for v := f.next(d.IFrame); v != nil; v = f.next(d.IFrame) {
+		f.tried[v] = true
+		u, err := f.base.Parse(v.URI)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		log.Printf("Variant with bandwidth %v failed: %v. Falling back to %v with bandwidth %v.\n",
+			f.current.Bandwidth, reason, u, v.Bandwidth)
+		f.current = v
+		f.errors = 0
+		return u
+	}
+	log.Printf("Variant with bandwidth %v failed: %v. No other variant left to fall back to.\n", f.current.Bandwidth, reason)
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "context"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "strings"
+import "testing"
+
+const testMaster = `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=500000
+low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1000000
+high.m3u8
+`
+
+func TestRedirectedMaster(t *testing.T) {
+	files := serveFiles(map[string]string{"/hls/master.m3u8": testMaster})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/master.m3u8" {
+			http.Redirect(w, r, "/hls/master.m3u8", http.StatusFound)
+			return
+		}
+		files(w, r)
+	}))
+	defer srv.Close()
+
+	d, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterURL, _ := url.Parse(srv.URL + "/master.m3u8")
+	_, baseURL, err := d.fetchMaster(context.Background(), masterURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.URL + "/hls/master.m3u8"; baseURL.String() != want {
+		t.Errorf("fetchMaster gave base %v, want %v", baseURL, want)
+	}
+
+	// The selected variant is still there.
+	current, _ := url.Parse(srv.URL + "/hls/high.m3u8")
+	if next := d.refreshVariant(context.Background(), masterURL, current); next != nil {
+		t.Errorf("refreshVariant switched to %v", next)
+	}
+	gone, _ := url.Parse(srv.URL + "/hls/gone.m3u8")
+	if next := d.refreshVariant(context.Background(), masterURL, gone); next == nil || next.String() != current.String() {
+		t.Errorf("refreshVariant switched to %v, want %v", next, current)
+	}
+
+	renditions, err := d.planRenditions(context.Background(), masterURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renditions[0].URI != current.String() {
+		t.Errorf("planRenditions selected %v, want %v", renditions[0].URI, current)
+	}
+}
+
+func TestAllVariantsStdout(t *testing.T) {
+	d, err := New(Options{AllVariants: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Download(context.Background(), "http://example.com/master.m3u8", "-")
+	if err == nil || !strings.Contains(err.Error(), "not standard output") {
+		t.Errorf("Download to - with AllVariants gave %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bufio"
+import "bytes"
+import "crypto/md5"
+import "encoding/hex"
+import "fmt"
+import "net/url"
+import "os"
+import "path"
+import "strings"
+
+// SegmentVerifier checks downloaded segments, e.g. against checksums
+// published next to the playlist. Verify returns an error if data is not
+// what the segment at uri should be; the segment is then downloaded again,
+// up to -retries times.
+type SegmentVerifier interface {
+	Verify(uri string, data []byte) error
+}
+
+// MD5Sidecar verifies segments against the MD5 sums of an md5sum style
+// file. Segments are looked up by URI and then by file name; those it does
+// not list pass.
+type MD5Sidecar map[string][]byte
+
+// LoadMD5Sidecar reads a file of "md5  name" lines as written by md5sum,
+// where name is a segment URI or file name.
+func LoadMD5Sidecar(fn string) (MD5Sidecar, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sums := MD5Sidecar{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%v: expected an MD5 sum and a segment name", fn, line)
+		}
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil || len(sum) != md5.Size {
+			return nil, fmt.Errorf("%v:%v: invalid MD5 sum %v", fn, line, fields[0])
+		}
+		// md5sum marks files read in binary mode with a '*'.
+		sums[strings.TrimPrefix(fields[1], "*")] = sum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(sums) == 0 {
+		return nil, fmt.Errorf("%v lists no segments", fn)
+	}
+	return sums, nil
+}
+
+// Verify checks data against the sum listed for uri, if any.
+func (s MD5Sidecar) Verify(uri string, data []byte) error {
+	expected, ok := s[uri]
+	if !ok {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil
+		}
+		if expected, ok = s[path.Base(u.Path)]; !ok {
+			return nil
+		}
+	}
+	if sum := md5.Sum(data); !bytes.Equal(sum[:], expected) {
+		return fmt.Errorf("MD5 sum %x, expected %x", sum, expected)
+	}
+	return nil
+}
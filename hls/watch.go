@@ -0,0 +1,63 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package hls
+
+import "bufio"
+import "bytes"
+import "context"
+import "log"
+import "time"
+
+// isLive reports whether the URL currently serves a stream or a playlist.
+func (d *Downloader) isLive(ctx context.Context, uri string) bool {
+	req, err := d.newRequest(ctx, "GET", uri, playlistRequest)
+	if err != nil {
+		d.fail(err)
+		return false
+	}
+	resp, err := d.doRequest(req)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return false
+	}
+	if isAudioStream(resp) || isDASHType(resp.Header.Get("Content-Type")) {
+		return true
+	}
+	head, _ := bufio.NewReader(resp.Body).Peek(512)
+	return bytes.HasPrefix(head, []byte("#EXTM3U")) || bytes.Contains(head, []byte("<MPD"))
+}
+
+// waitForStream polls the URL until it serves a stream or playlist, for
+// launching ahead of a scheduled broadcast. It returns false if ctx ends
+// first.
+func (d *Downloader) waitForStream(ctx context.Context, uri string, interval time.Duration) bool {
+	for !d.isLive(ctx, uri) {
+		if ctx.Err() != nil {
+			return false
+		}
+		log.Printf("%v is not live yet. Checking again in %v.\n", uri, interval)
+		if !sleep(ctx, interval) {
+			return false
+		}
+	}
+	return true
+}
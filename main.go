@@ -17,317 +17,553 @@
 
 package main
 
+import "context"
+import "encoding/json"
+import "errors"
 import "flag"
 import "fmt"
-import "io"
-import "net/http"
-import "net/url"
 import "log"
+import "net"
+import "net/url"
 import "os"
-import "time"
-import "github.com/golang/groupcache/lru"
+import "os/signal"
+import "path/filepath"
+import "regexp"
 import "strings"
-import "github.com/kz26/m3u8"
+import "sync"
+import "text/template"
+import "time"
+import "github.com/bamse16/gohls/hls"
 
 const version = "1.1.0"
 
-var userAgent string
+// exitCodes lets scripts tell the failure modes apart.
+var exitCodes = []struct {
+	err  error
+	code int
+}{
+	{hls.ErrHTTP, 3},
+	{hls.ErrPlaylistDecode, 4},
+	{hls.ErrAuth, 5},
+	{hls.ErrSegmentGone, 6},
+	{hls.ErrStreamEnded, 7},
+	{hls.ErrStalled, 8},
+	{hls.ErrGap, 9},
+}
 
-var client = &http.Client{}
+func exitCode(err error) int {
+	for _, e := range exitCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return 1
+}
 
-func doRequest(c *http.Client, req *http.Request) (*http.Response, error) {
-	req.Header.Set("User-Agent", userAgent)
-	resp, err := c.Do(req)
-	return resp, err
+// fatal logs err and exits with the code for its failure mode, like
+// log.Fatal does with 1.
+func fatal(err error) {
+	log.Print(colored(red, err.Error()))
+	os.Exit(exitCode(err))
 }
 
-// Download stores URI/duration to process
-type Download struct {
-	URI           string
-	totalDuration time.Duration
+// ANSI colors for messages that should stand out.
+const (
+	red    = "31"
+	yellow = "33"
+)
+
+// color is set when log messages go to a terminal that takes colors.
+var color bool
+
+// isTerminal tells whether f is an interactive terminal rather than a
+// file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
-type stream struct {
-	URI       string
-	localFile string
+func colored(code, msg string) string {
+	if !color {
+		return msg
+	}
+	return "\x1b[" + code + "m" + msg + "\x1b[0m"
 }
 
-func downloadSegment(fn string, dlc chan *Download) {
-	out, err := os.OpenFile(fn, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+// setFlagsFromEnv sets the flags of fs from GOHLS_* environment variables,
+// e.g. GOHLS_MAX_BANDWIDTH for -max-bandwidth, once the command line is
+// parsed. Flags on the command line win, also repeatable ones, which the
+// variable would otherwise add to. It returns the names of the variables
+// used.
+func setFlagsFromEnv(fs *flag.FlagSet) ([]string, error) {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var used []string
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := "GOHLS_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(name); ok && !given[f.Name] && err == nil {
+			if err = fs.Set(f.Name, value); err != nil {
+				err = fmt.Errorf("invalid value %q for %v: %v", value, name, err)
+				return
+			}
+			used = append(used, name)
+		}
+	})
+	return used, err
+}
 
-	if err != nil {
-		log.Fatal(err)
+// Flags whose values -verbose does not log.
+var secretFlags = map[string]bool{
+	"user":      true,
+	"token-cmd": true,
+}
+
+// Flags holding URLs, which may carry credentials or presigned signatures.
+var urlFlags = map[string]bool{
+	"segment-base": true,
+	"sink":         true,
+}
+
+// logConfig logs every flag with its effective value for -verbose, and the
+// arguments, leaving out passwords and tokens.
+func logConfig(env []string) {
+	log.Print("Configuration:")
+	flag.VisitAll(func(f *flag.Flag) {
+		log.Printf("  -%v=%v\n", f.Name, configValue(f))
+	})
+	if len(env) > 0 {
+		log.Printf("  from the environment: %v\n", strings.Join(env, ", "))
 	}
-	defer out.Close()
-	for v := range dlc {
-		onDownload(v, out)
+	for _, arg := range flag.Args() {
+		log.Printf("  %v\n", redactURL(arg))
 	}
 }
 
-func onDownload(v *Download, out *os.File) {
-	req, err := http.NewRequest("GET", v.URI, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	resp, err := doRequest(client, req)
-	if err != nil {
-		log.Print(err)
-		return
+// configValue returns the value of f as logConfig logs it.
+func configValue(f *flag.Flag) string {
+	value := f.Value.String()
+	if secretFlags[f.Name] && value != "" {
+		return "xxxxx"
 	}
-	if resp.StatusCode != 200 {
-		log.Printf("Received HTTP %v for %v\n", resp.StatusCode, v.URI)
-		return
+	if tees, ok := f.Value.(*hls.Tees); ok {
+		var dests []string
+		for _, dest := range *tees {
+			dests = append(dests, redactURL(dest))
+		}
+		return strings.Join(dests, ", ")
 	}
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		log.Fatal(err)
+	if urlFlags[f.Name] {
+		return redactURL(value)
 	}
-	resp.Body.Close()
-	log.Printf("Downloaded %v. Recorded %v.\n", v.URI, v.totalDuration)
+	return value
 }
 
-func downloadURI(v *stream, out *os.File) {
-	req, err := http.NewRequest("GET", v.URI, nil)
-	if err != nil {
-		log.Fatal(err)
+// redactURL replaces the password and the query of an absolute URL with
+// xxxxx. Anything else is returned as it is.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		return s
 	}
-	resp, err := doRequest(client, req)
-	defer resp.Body.Close()
-	if err != nil {
-		log.Print(err)
-		return
+	// Tokens are often passed in the query.
+	if u.RawQuery != "" {
+		u.RawQuery = "xxxxx"
 	}
-	if resp.StatusCode != 200 {
-		log.Printf("Received HTTP %v for %v.\n", resp.StatusCode, v.URI)
-		return
+	return u.Redacted()
+}
+
+// openOutputFD returns the file of descriptor fd, checking that the parent
+// process passed it open for writing.
+func openOutputFD(fd int) (*os.File, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %v", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid -output-fd %v", fd)
 	}
-	log.Printf("Downloading %v to %v.\n", v.URI, v.localFile)
-	written, err := io.Copy(out, resp.Body)
-	if err != nil {
-		log.Fatal(err)
+	if _, err := f.Stat(); err != nil {
+		return nil, fmt.Errorf("-output-fd %v is not open: %v", fd, err)
+	}
+	// An empty write fails if the descriptor is read only.
+	if _, err := f.Write(nil); err != nil {
+		return nil, fmt.Errorf("-output-fd %v is not open for writing: %v", fd, err)
 	}
+	return f, nil
+}
 
-	log.Printf("Downloaded %v kb from %v.\n", written/1000, v.URI)
+// warmUpDNS looks up the host of uri, and of -segment-base if given, before
+// the first requests, so the answers are in the system resolver's cache by
+// the time they are needed. Failures are left for the download to report.
+func warmUpDNS(ctx context.Context, uri string, segmentBase *url.URL) {
+	hosts := map[string]bool{}
+	if u, err := url.Parse(uri); err == nil && u.Hostname() != "" {
+		hosts[u.Hostname()] = true
+	}
+	if segmentBase != nil {
+		hosts[segmentBase.Hostname()] = true
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for host := range hosts {
+		if net.ParseIP(host) != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			start := time.Now()
+			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err != nil {
+				log.Printf("Could not resolve %v ahead of time. %v\n", host, err)
+				return
+			}
+			log.Printf("Resolved %v to %v in %v.\n", host, strings.Join(addrs, ", "), time.Since(start).Round(time.Millisecond))
+		}(host)
+	}
+	wg.Wait()
 }
 
-func downloadStream(s *stream) {
-	if downloadInProgress(s.localFile) {
-		log.Printf("Download in progress for %v.\n", s)
-		return
+// parseRange parses -range, two durations separated by a colon. The end may
+// be left out to record to the end of the playlist.
+func parseRange(s string) (start, end time.Duration, err error) {
+	bounds := strings.SplitN(s, ":", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %q, expected start:end, e.g. 10m:12m30s", s)
+	}
+	if bounds[0] != "" {
+		if start, err = time.ParseDuration(bounds[0]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if bounds[1] != "" {
+		if end, err = time.ParseDuration(bounds[1]); err != nil {
+			return 0, 0, err
+		}
 	}
+	return start, end, nil
+}
 
-	out, err := os.OpenFile(s.localFile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+func main() {
+	opts := hls.Options{MaxSegmentSize: 512 << 20, MaxPlaylistSize: 8 << 20}
+	flag.BoolVar(&opts.UseLocalTime, "l", false, "Use local time to track duration instead of supplied metadata")
+	flag.DurationVar(&opts.Duration, "t", 0, "Recording duration (0 == infinite)")
+	flag.IntVar(&opts.QueueSize, "queue-size", 1024, "Number of segments queued between the playlist poller and the downloader")
+	flag.UintVar(&opts.MinBandwidth, "min-bandwidth", 0, "Minimum variant bandwidth in bits/s when given a master playlist")
+	flag.UintVar(&opts.MaxBandwidth, "max-bandwidth", 0, "Maximum variant bandwidth in bits/s when given a master playlist (0 == unlimited)")
+	flag.DurationVar(&opts.MasterRefresh, "follow-master-refresh", 0, "Re-read a live master playlist this often and switch variants if the selected one disappears (0 == never)")
+	flag.BoolVar(&opts.FollowVariantOnError, "follow-variant-on-error", false, "Fall back to the next best variant of a master playlist when the selected one keeps failing")
+	flag.StringVar(&opts.BasicAuth, "user", "", "HTTP basic auth credentials as user:password (default: look up the host in ~/.netrc)")
+	flag.StringVar(&opts.NetrcFile, "netrc", hls.NetrcPath(), "File to read HTTP basic auth credentials from when -user is not given")
+	flag.StringVar(&opts.TokenCommand, "token-cmd", "", "Command printing an access token for the Authorization header, rerun on HTTP 401/403")
+	flag.StringVar(&opts.SegmentsDir, "segments-dir", "", "Also save each segment as a separate file in this directory")
+	flag.StringVar(&opts.DedupKey, "dedup-key", "uri", "Tell live segments apart by URI (uri) or by media sequence number and URI (seq+uri), for encoders that reuse URIs")
+	flag.StringVar(&opts.SegmentNames, "segment-names", "seq", "Name segment files by media sequence number (seq) or program-date-time (pdt)")
+	flag.DurationVar(&opts.Skip, "skip", 0, "Skip this much media at the start of the playlist")
+	include := flag.String("include", "", "Only record segments whose URI matches this regular expression")
+	exclude := flag.String("exclude", "", "Leave out segments whose URI matches this regular expression, e.g. ads")
+	md5Verify := flag.String("segment-md5-verify", "", "Check segments against the MD5 sums in this md5sum style file and retry those that do not match")
+	retryIfBody := flag.String("retry-if-body-matches", "", "Retry segments whose first kilobyte matches this regular expression, e.g. (?i)<html")
+	sinceStr := flag.String("since", "", "Only record segments with a program-date-time after this RFC 3339 time")
+	rangeStr := flag.String("range", "", "Only record the VOD segments overlapping start:end, e.g. 10m:12m30s")
+	flag.BoolVar(&opts.NormalizeTimestamps, "normalize-timestamps", false, "Remux the output with ffmpeg afterwards so its timestamps run on continuously across segments")
+	flag.BoolVar(&opts.RangeExact, "range-exact", false, "Cut the output to exactly -range with ffmpeg (re-encodes)")
+	maxRuntime := flag.Duration("max-runtime", 0, "Maximum wall-clock run time, regardless of recorded duration (0 == infinite)")
+	flag.StringVar(&opts.UserAgent, "ua", fmt.Sprintf("gohls/%v", version), "User-Agent for HTTP client")
+	flag.StringVar(&opts.PlaylistUserAgent, "playlist-ua", "", "User-Agent for playlist requests (default: -ua)")
+	flag.StringVar(&opts.PlaylistAccept, "playlist-accept", hls.DefaultPlaylistAccept, "Accept header for playlist requests")
+	flag.StringVar(&opts.SegmentUserAgent, "segment-ua", "", "User-Agent for segment requests (default: -ua)")
+	flag.StringVar(&opts.KeyUserAgent, "key-ua", "", "User-Agent for decryption key requests (default: -ua)")
+	uaPresetName := flag.String("ua-preset", "", "Use the User-Agent of a common browser or player ("+uaPresetNames()+"); -ua takes precedence")
+	flag.BoolVar(&opts.HTTP3, "http3", false, "Try HTTP/3 (QUIC) first, falling back to HTTP/2 (needs a build with -tags http3)")
+	flag.StringVar(&opts.TLSMinVersion, "tls-min-version", "", "Minimum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	flag.StringVar(&opts.TLSMaxVersion, "tls-max-version", "", "Maximum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	flag.StringVar(&opts.TLSCiphers, "tls-ciphers", "", "Comma separated list of TLS cipher suites")
+	flag.BoolVar(&opts.AppendPAT, "append-ts-pat", false, "Make sure each MPEG-TS segment starts with a PAT/PMT so the output is seekable")
+	flag.BoolVar(&opts.DedupContent, "dedup-content", false, "Skip segments whose content is identical to the previous segment")
+	flag.BoolVar(&opts.ValidateCC, "validate-cc", false, "Check the MPEG-TS continuity counters of the output when done and report lost or misordered packets per PID")
+	flag.BoolVar(&opts.ExtractCaptions, "extract-captions", false, "Write the CEA-608 captions embedded in the video of MPEG-TS segments to output.vtt")
+	flag.BoolVar(&opts.Demux, "demux", false, "Also demux MPEG-TS segments into elementary stream files (output.h264, output.aac)")
+	flag.BoolVar(&opts.Trace, "trace", false, "Collect DNS/connect/TLS/TTFB/transfer timings per segment and print a summary")
+	flag.IntVar(&opts.Retries, "retries", 3, "Retry a segment this many times after a network error or HTTP 429/5xx")
+	flag.StringVar(&opts.Mode, "mode", "auto", "Whether the stream is live or vod, for the defaults of live streams; auto tells from the playlist")
+	flag.IntVar(&opts.Reconnect, "reconnect", 0, "Reconnect to a live stream this many times when it is lost while recording, appending to the same output")
+	flag.BoolVar(&opts.LiveDeadline, "live-deadline", false, "Drop a live segment instead of retrying it when it would leave the live window first, to keep up with the live edge")
+	flag.DurationVar(&opts.MaxBackoff, "max-backoff", 60*time.Second, "Longest wait between retries of a segment or playlist, which doubles after each error")
+	flag.BoolVar(&opts.SegmentCompression, "segment-compression", false, "Accept gzip for segment requests too, for servers that compress uncompressed media")
+	flag.BoolVar(&opts.Precheck, "precheck", false, "Check that all VOD segments exist with HEAD requests before downloading")
+	flag.Var(&opts.MaxPlaylistSize, "max-playlist-size", "Fail on playlists larger than this, e.g. 8M (0 == unlimited)")
+	flag.Var(&opts.MaxSegmentSize, "max-segment-size", "Reject segments larger than this, e.g. 512M (0 == unlimited)")
+	flag.BoolVar(&opts.OnlyAudio, "only-audio", false, "Keep only the audio streams of MPEG-TS segments")
+	flag.BoolVar(&opts.OnlyVideo, "only-video", false, "Keep only the video streams of MPEG-TS segments")
+	flag.StringVar(&opts.Sink, "sink", "", "Stream the output to this http(s) URL instead of a local file; {name} is replaced by the output name")
+	flag.StringVar(&opts.SinkMethod, "sink-method", "PUT", "HTTP method for -sink (PUT or POST)")
+	flag.StringVar(&opts.Keystore, "keystore", "", "Keep fetched decryption keys in this file, readable only by you, and use them when the key server fails, e.g. on -resume")
+	flag.BoolVar(&opts.Resume, "resume", false, "Resume an interrupted VOD or direct download, using range requests where possible")
+	flag.BoolVar(&opts.Preallocate, "preallocate", false, "Preallocate disk space for VOD downloads, estimated from the first segment")
+	flag.StringVar(&opts.AudioLang, "audio-lang", "", "Also record the alternate audio rendition in this language and mux it into the output with ffmpeg")
+	flag.StringVar(&opts.SubLang, "sub-lang", "", "Also record the subtitle rendition in this language and mux it into the output with ffmpeg")
+	flag.BoolVar(&opts.KeepTemp, "keep-temp", false, "Keep the temporary files of -audio-lang, -sub-lang and -first-segment-only")
+	flag.BoolVar(&opts.AutoExt, "auto-ext", false, "Append the extension of the detected format (.ts, .aac, .mp4, ...) to the output file name; always done when it has none")
+	flag.BoolVar(&opts.FirstSegmentOnly, "first-segment-only", false, "Only download the first segment to a temporary file and report its size and streams, as a health check; no output file needed")
+	flag.DurationVar(&opts.ProbeDuration, "probe-duration", 0, "Only download about this much of the stream, report the bitrate and the projected size of a recording and exit; no output file needed (0 == off)")
+	listSegments := flag.Bool("list-segments-json", false, "Print the segments of the media playlist that would be recorded as JSON and exit; a snapshot for live streams, no output file needed")
+	dnsWarmup := flag.Bool("dns-warmup", false, "Look up the playlist host before starting, to have it in the system DNS cache for the first requests")
+	outputFD := flag.Int("output-fd", -1, "Write the recording to this file descriptor, opened for writing by the parent process, instead of an output file")
+	printURL := flag.Bool("print-url-only", false, "Print the URL of the media playlist that would be recorded, after variant selection and redirects, and exit; no output file needed")
+	flag.BoolVar(&opts.Watch, "watch", false, "Keep polling until the URL serves a stream or playlist, e.g. ahead of a scheduled event")
+	flag.DurationVar(&opts.WatchInterval, "watch-interval", 30*time.Second, "How often -watch polls the URL")
+	flag.BoolVar(&opts.AllVariants, "all-variants", false, "Record every variant of a master playlist at once, each to its own output file")
+	flag.IntVar(&opts.MaxParallel, "max-parallel", 0, "Maximum segments downloaded at the same time across all variants (0 == unlimited)")
+	flag.Var(&opts.SplitSize, "split-size", "Start a new output file at the next segment once the current one reaches this size, e.g. 2G (0 == off)")
+	flag.Var(&opts.BufferMemory, "buffer-memory", "Keep the output in memory up to this size, e.g. 64M, and write it at the end so a failed download leaves no partial file (0 == off)")
+	flag.BoolVar(&opts.ChecksumManifest, "checksum-manifest", false, "Write the SHA-256 hash and size of each segment to <output>.sha256")
+	flag.DurationVar(&opts.Refresh, "refresh", 0, "Reload live playlists this often instead of every target duration (0 == use the target duration)")
+	flag.BoolVar(&opts.IFrame, "iframe", false, "Record the I-frame only variant of a master playlist, e.g. for thumbnails")
+	flag.DurationVar(&opts.ConnectTimeout, "connect-timeout", 30*time.Second, "Give up connecting to a host after this long; does not limit the transfer itself")
+	flag.BoolVar(&opts.NoHappyEyeballs, "no-happy-eyeballs", false, "Try the addresses of a host one after the other instead of racing IPv6 and IPv4 connections")
+	flag.StringVar(&opts.Interface, "interface", "", "Make connections from this network interface or source IP address")
+	flag.DurationVar(&opts.MaxGap, "max-gap", 0, "Warn when live segments are further apart than this by EXT-X-PROGRAM-DATE-TIME (0 == off)")
+	flag.BoolVar(&opts.AbortOnGap, "abort-on-gap", false, "Stop with an error when -max-gap is exceeded")
+	flag.DurationVar(&opts.StallTimeout, "stall-timeout", 0, "Stop with an error when the output has not grown for this long (0 == 2m for live streams, negative == never)")
+	flag.DurationVar(&opts.TrimEnd, "trim-end", 0, "Only record live segments at least this far behind the live edge")
+	flag.IntVar(&opts.Concurrency, "concurrency", 1, "Number of segments to download at the same time")
+	flag.IntVar(&opts.SegmentConnections, "segment-connections", 1, "Download each segment over this many connections with range requests, if the server supports them")
+	flag.BoolVar(&opts.AutoConcurrency, "auto-concurrency", false, "Adjust the number of segments downloaded at the same time to the measured throughput, up to -concurrency or 16")
+	flag.Var(&opts.MaxInflightBytes, "max-inflight-bytes", "With -concurrency, hold at most this much downloaded ahead in memory, e.g. 64M (0 == unlimited)")
+	flag.BoolVar(&opts.Progressive, "progressive", false, "With -concurrency, download segments close to the start first so the output becomes playable early")
+	segmentBase := flag.String("segment-base", "", "Resolve relative segment URIs against this URL instead of the playlist URL")
+	flag.BoolVar(&opts.KeyQuery, "key-query", false, "Append the query of the playlist URL, e.g. a signing token, to AES key URIs that have none of their own")
+	flag.DurationVar(&opts.FlushInterval, "flush-interval", 0, "When writing to a pipe, standard output or -sink, collect segments for this long before passing them on (0 == after every segment)")
+	flag.Var(&opts.Tee, "tee", "Also write the recording to this file, - for standard output or http(s) URL, e.g. to restream it while recording (repeatable)")
+	flag.BoolVar(&opts.TeeErrorsFatal, "tee-errors-fatal", false, "Fail the download when a -tee destination fails instead of recording on without it")
+	flag.Var(&opts.Rewrites, "rewrite", "Rewrite segment URIs with a 'pattern=>replacement' regular expression rule (repeatable)")
+	flag.BoolVar(&opts.Lenient, "lenient", false, "Skip playlist lines that cannot be parsed instead of failing")
+	strict := flag.Bool("strict", false, "Fail on any playlist line that cannot be parsed (the default; cannot be combined with -lenient)")
+	flag.StringVar(&opts.AdMarkers, "ad-markers", "", "Write the EXT-X-DATERANGE ad markers of the stream to this file, with their offsets in the recording")
+	flag.BoolVar(&opts.SkipAds, "skip-ads", false, "Leave out segments within SCTE-35 ad breaks marked with EXT-X-DATERANGE")
+	flag.StringVar(&opts.CacheDir, "cache-dir", "", "Keep HTTP responses in this directory and reuse them on later runs while their cache headers allow")
+	flag.BoolVar(&opts.CacheAlways, "cache-always", false, "With -cache-dir, reuse cached segments and keys without asking the server, e.g. for repeated downloads of a VOD")
+	flag.StringVar(&opts.DumpHeaders, "dump-headers", "", "Append the headers of every HTTP response to this file, for debugging")
+	daemon := flag.Bool("daemon", false, "Keep running and record during the -schedule windows, to a new file each time")
+	var sched schedule
+	flag.Var(&sched, "schedule", "Recording window for -daemon in local time, e.g. 'Mon-Fri 18:00-19:30' (repeatable)")
+	reportTemplate := flag.String("report-template", "", "When done, write a report of the download in the format of this Go text/template file to stdout")
+	replay := flag.String("replay", "", "Download the segments listed in a -checksum-manifest file again and check them, instead of reading a playlist")
+	logFile := flag.String("log-file", "", "Append log messages to this file instead of writing them to stderr")
+	useSyslog := flag.Bool("syslog", false, "Send log messages to syslog instead of stderr")
+	noColor := flag.Bool("no-color", false, "Do not color messages; colors are only used on a terminal and not with NO_COLOR set either")
+	verbose := flag.Bool("verbose", false, "Log the effective configuration at startup, without passwords and tokens")
+	flag.Parse()
+	env, err := setFlagsFromEnv(flag.CommandLine)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	shouldWait := false
-	shortSleepInterval := time.Duration(1) * time.Second
-	longSleepInterval := time.Duration(10) * time.Second
+	if *strict && opts.Lenient {
+		log.Fatal("-strict and -lenient are mutually exclusive")
+	}
+	// https://no-color.org
+	color = !*noColor && os.Getenv("NO_COLOR") == "" && *logFile == "" && !*useSyslog && isTerminal(os.Stderr)
+	if *logFile != "" && *useSyslog {
+		log.Fatal("-log-file and -syslog are mutually exclusive")
+	}
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+	}
+	if *useSyslog {
+		w, err := openSyslog()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// syslog adds its own timestamps.
+		log.SetFlags(0)
+		log.SetOutput(w)
+	}
 
-	shortTicks := 0
-	longTicks := 0
+	os.Stderr.Write([]byte(fmt.Sprintf("gohls %v - HTTP Live Streaming (HLS) downloader\n", version)))
+	os.Stderr.Write([]byte("Copyright (C) 2013-2014 Kevin Zhang. Licensed for use under the GNU GPL version 3.\n"))
 
-	maxTicks := 30
+	if flag.NArg() < 2 && !((opts.FirstSegmentOnly || opts.ProbeDuration > 0 || *printURL || *listSegments || *outputFD >= 0 || *replay != "") && flag.NArg() == 1) {
+		os.Stderr.Write([]byte("Usage: gohls [-l=bool] [-t duration] [-ua user-agent] media-playlist-url output-file\n"))
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
 
-	for {
-		req, err := http.NewRequest("GET", s.URI, nil)
+	if *replay == "" && !strings.HasPrefix(flag.Arg(0), "http") {
+		log.Fatal("Media playlist url must begin with http/https")
+	}
+	output := flag.Arg(1)
+	if *outputFD >= 0 {
+		if *replay != "" || flag.NArg() > 1 {
+			log.Fatal("-output-fd replaces the output file and cannot be used with -replay")
+		}
+		opts.OutputFile, err = openOutputFD(*outputFD)
 		if err != nil {
 			log.Fatal(err)
 		}
-		resp, err := doRequest(client, req)
-		defer resp.Body.Close()
-
-		// If provided url is already a stream, just save it
-		if isAudioStream(resp) {
-			shouldWait = true
-			shortTicks = 0
-			longTicks = 0
-			downloadURI(s, out)
-		} else {
-
-			sleepInterval := longSleepInterval
-			if shortTicks < maxTicks {
-				shortTicks = shortTicks + 1
-				sleepInterval = shortSleepInterval
-			} else if longTicks < maxTicks {
-				longTicks = longTicks + 1
-			} else {
-				break // Break after longTicks > maxTicks
-			}
-
-			if shouldWait {
-				log.Printf("Sleeping for %v.", sleepInterval)
-			} else {
-				log.Print("URL not a stream. Bailing.")
-				break
+		output = opts.OutputFile.Name()
+	}
+	if *uaPresetName != "" {
+		uaSet := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "ua" {
+				uaSet = true
 			}
-			time.Sleep(sleepInterval)
+		})
+		ua, err := uaPreset(*uaPresetName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !uaSet {
+			opts.UserAgent = ua
 		}
 	}
-}
-
-func downloadInProgress(fn string) bool {
-	inProgress := false
-
-	info, err := os.Stat(fn)
-	if os.IsNotExist(err) {
-		return inProgress
-	}
-	if err != nil {
-		log.Printf("Could not get stats for %v. %v", fn, err)
-		return inProgress
+	if *sinceStr != "" {
+		opts.Since, err = time.Parse(time.RFC3339, *sinceStr)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	delta := time.Now().Sub(info.ModTime())
-	justUpdated := delta < time.Duration(5)*time.Minute
-	notEmpty := info.Size() > 0
-	inProgress = justUpdated && notEmpty
-
-	log.Printf("File %v modified %v ago. Size: %v.\n", fn, delta, info.Size())
-
-	return inProgress
-}
-
-func getPlaylist(urlStr string, useLocalTime bool, dlc chan *Download) {
-	startTime := time.Now()
-	var recDuration time.Duration
-	cache := lru.New(1024)
-	playlistURL, err := url.Parse(urlStr)
-	if err != nil {
-		log.Fatal(err)
+	if *segmentBase != "" {
+		opts.SegmentBase, err = url.Parse(*segmentBase)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !opts.SegmentBase.IsAbs() {
+			log.Fatal("-segment-base must be an absolute URL")
+		}
 	}
-	for {
-		req, err := http.NewRequest("GET", urlStr, nil)
+	if *rangeStr != "" {
+		opts.RangeStart, opts.RangeEnd, err = parseRange(*rangeStr)
 		if err != nil {
 			log.Fatal(err)
 		}
-		resp, err := doRequest(client, req)
-
-		// If provided url is already a stream, just save it
-		if isAudioStream(resp) {
-			resp.Body.Close()
-			recDuration := 12 * time.Hour
-			dlc <- &Download{urlStr, recDuration}
-			return
+	}
+	if *include != "" {
+		opts.Include, err = regexp.Compile(*include)
+		if err != nil {
+			log.Fatal(err)
 		}
-
+	}
+	if *exclude != "" {
+		opts.Exclude, err = regexp.Compile(*exclude)
 		if err != nil {
-			log.Print(err)
-			time.Sleep(time.Duration(3) * time.Second)
+			log.Fatal(err)
 		}
-		playlist, listType, err := m3u8.DecodeFrom(resp.Body, true)
+	}
+	if *retryIfBody != "" {
+		opts.RetryIfBodyMatches, err = regexp.Compile(*retryIfBody)
 		if err != nil {
 			log.Fatal(err)
 		}
-		resp.Body.Close()
-		if listType == m3u8.MEDIA {
-			mpl := playlist.(*m3u8.MediaPlaylist)
-			for _, v := range mpl.Segments {
-				if v != nil {
-					var msURI string
-					if strings.HasPrefix(v.URI, "http") {
-						msURI, err = url.QueryUnescape(v.URI)
-						if err != nil {
-							log.Fatal(err)
-						}
-					} else {
-						msURL, err := playlistURL.Parse(v.URI)
-						if err != nil {
-							log.Print(err)
-							continue
-						}
-						msURI, err = url.QueryUnescape(msURL.String())
-						if err != nil {
-							log.Fatal(err)
-						}
-					}
-					_, hit := cache.Get(msURI)
-					if !hit {
-						cache.Add(msURI, nil)
-						if useLocalTime {
-							recDuration = time.Now().Sub(startTime)
-						} else {
-							recDuration += time.Duration(int64(v.Duration * 1000000000))
-						}
-						dlc <- &Download{msURI, recDuration}
-					}
-				}
-			}
-			if mpl.Closed {
-				close(dlc)
-				return
-			}
-
-			time.Sleep(time.Duration(int64(mpl.TargetDuration * 1000000000)))
-
-		} else {
-			log.Fatal("Not a valid media playlist")
+	}
+	if *md5Verify != "" {
+		sums, err := hls.LoadMD5Sidecar(*md5Verify)
+		if err != nil {
+			log.Fatal(err)
 		}
+		opts.Verifier = sums
 	}
-}
-
-func debugResponse(r *http.Response) string {
-	var request []string
-
-	request = append(request, "Headers:")
-
-	// Headers
-	for name, headers := range r.Header {
-		name = strings.ToLower(name)
-		for _, h := range headers {
-			request = append(request, fmt.Sprintf("%v: %v", name, h))
+	if *reportTemplate != "" {
+		opts.ReportTemplate, err = template.New(filepath.Base(*reportTemplate)).Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+		}).ParseFiles(*reportTemplate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if flag.Arg(flag.NArg()-1) == "-" {
+			// The recording goes to stdout.
+			opts.ReportOutput = os.Stderr
 		}
 	}
+	if *daemon && len(sched) == 0 {
+		log.Fatal("-daemon needs at least one -schedule")
+	}
+	if opts.Concurrency < 1 {
+		log.Fatal("Concurrency must be at least 1")
+	}
+	if opts.WatchInterval <= 0 {
+		log.Fatal("Watch interval must be positive")
+	}
+	if *verbose {
+		logConfig(env)
+	}
 
-	request = append(request, fmt.Sprintf("Status: %v", r.StatusCode))
+	d, err := hls.New(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	return strings.Join(request, "\n")
-}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, shutdownSignals...)
+	go func() {
+		<-sigs
+		log.Print(colored(yellow, "Interrupted. Finishing the output; interrupt again to quit at once."))
+		stop()
+		<-sigs
+		os.Exit(130)
+	}()
+	if *maxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *maxRuntime)
+		defer cancel()
+	}
 
-func isAudioStream(r *http.Response) bool {
-	streams := []string{
-		"audio/aacp",
-		"audio/mpeg",
+	if *dnsWarmup {
+		warmUpDNS(ctx, flag.Arg(0), opts.SegmentBase)
 	}
-	isStream := false
 
-	for name, headers := range r.Header {
-		name = strings.ToLower(name)
-		if name != "content-type" {
-			continue
+	if *daemon {
+		recordOnSchedule(ctx, d, sched, flag.Arg(0), output)
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Print(colored(yellow, fmt.Sprintf("Maximum run time of %v reached.", *maxRuntime)))
+			return
 		}
+		os.Exit(130)
+	}
 
-		for _, h := range headers {
-			h = strings.ToLower(h)
-			for _, stream := range streams {
-				if stream == h {
-					isStream = true
-				}
-			}
+	if *printURL {
+		var resolved string
+		resolved, err = d.ResolveURL(ctx, flag.Arg(0))
+		if err == nil {
+			fmt.Println(resolved)
+		}
+	} else if *listSegments {
+		var list *hls.SegmentList
+		list, err = d.ListSegments(ctx, flag.Arg(0))
+		if err == nil {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(list)
 		}
+	} else if *replay != "" {
+		err = d.Replay(ctx, *replay, flag.Arg(flag.NArg()-1))
+	} else {
+		err = d.Download(ctx, flag.Arg(0), output)
 	}
-
-	return isStream
-}
-
-func main() {
-	flag.StringVar(&userAgent, "ua", fmt.Sprintf("gohls/%v", version), "User-Agent for HTTP client")
-	flag.Parse()
-
-	os.Stderr.Write([]byte(fmt.Sprintf("gohls %v - HTTP Live Streaming (HLS) downloader\n", version)))
-	os.Stderr.Write([]byte("Copyright (C) 2013-2014 Kevin Zhang. Licensed for use under the GNU GPL version 3.\n"))
-
-	if flag.NArg() < 2 {
-		os.Stderr.Write([]byte("Usage: gohls [-l=bool] [-t duration] [-ua user-agent] media-playlist-url output-file\n"))
-		flag.PrintDefaults()
-		os.Exit(2)
+	if err == nil && opts.FirstSegmentOnly {
+		log.Print("The stream looks fine.")
 	}
-
-	if !strings.HasPrefix(flag.Arg(0), "http") {
-		log.Fatal("Media playlist url must begin with http/https")
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Print(colored(yellow, fmt.Sprintf("Maximum run time of %v reached.", *maxRuntime)))
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if ctx.Err() == context.Canceled {
+		// Interrupted.
+		os.Exit(130)
 	}
-
-	s := stream{flag.Arg(0), flag.Arg(1)}
-	downloadStream(&s)
 }
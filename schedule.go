@@ -0,0 +1,194 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import "context"
+import "fmt"
+import "log"
+import "path/filepath"
+import "strings"
+import "time"
+import "github.com/bamse16/gohls/hls"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// window is a recurring recording time in local time, e.g. Mon-Fri
+// 18:00-19:30. A window ending before it starts runs past midnight.
+type window struct {
+	days       [7]bool
+	start, end time.Duration // since midnight
+}
+
+// schedule holds the windows given with -schedule. It implements flag.Value.
+type schedule []window
+
+func (s *schedule) String() string {
+	return fmt.Sprintf("%v windows", len(*s))
+}
+
+// Set parses "[days] HH:MM-HH:MM", where days is a comma separated list of
+// weekdays or ranges of them, e.g. "Mon-Fri" or "Sat,Sun". Without days,
+// the window applies every day.
+func (s *schedule) Set(value string) error {
+	w := window{}
+	fields := strings.Fields(value)
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		if err := w.parseDays(fields[0]); err != nil {
+			return err
+		}
+		fields = fields[1:]
+	default:
+		return fmt.Errorf("invalid schedule %q, expected e.g. \"Mon-Fri 18:00-19:30\"", value)
+	}
+	times := strings.SplitN(fields[0], "-", 2)
+	if len(times) != 2 {
+		return fmt.Errorf("invalid time range %q, expected e.g. 18:00-19:30", fields[0])
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(times[0]); err != nil {
+		return err
+	}
+	if w.end, err = parseTimeOfDay(times[1]); err != nil {
+		return err
+	}
+	if w.start == w.end {
+		return fmt.Errorf("empty time range %q", fields[0])
+	}
+	*s = append(*s, w)
+	return nil
+}
+
+func (w *window) parseDays(spec string) error {
+	for _, part := range strings.Split(strings.ToLower(spec), ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return fmt.Errorf("unknown weekday %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return fmt.Errorf("unknown weekday %q", bounds[1])
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// next returns the start and end of the next window that has not ended by
+// now. The start is in the past if now is inside a window.
+func (s schedule) next(now time.Time) (start, end time.Time) {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	// Yesterday's window may still run past midnight.
+	for day := -1; day <= 7; day++ {
+		date := midnight.AddDate(0, 0, day)
+		for _, w := range s {
+			if !w.days[date.Weekday()] {
+				continue
+			}
+			ws := date.Add(w.start)
+			we := date.Add(w.end)
+			if w.end < w.start {
+				we = date.AddDate(0, 0, 1).Add(w.end)
+			}
+			if we.After(now) && (start.IsZero() || ws.Before(start)) {
+				start, end = ws, we
+			}
+		}
+		if !start.IsZero() && !start.After(date.AddDate(0, 0, 1)) {
+			break
+		}
+	}
+	return start, end
+}
+
+// recordOnSchedule records uri during every window of sched until ctx is
+// done. Errors only end the current recording.
+func recordOnSchedule(ctx context.Context, d *hls.Downloader, sched schedule, uri, output string) {
+	for ctx.Err() == nil {
+		start, end := sched.next(time.Now())
+		if time.Now().Before(start) {
+			log.Printf("Next recording from %v to %v.\n", start.Format(time.RFC1123), end.Format(time.RFC1123))
+			if !waitUntil(ctx, start) {
+				return
+			}
+		}
+		// Named by the actual start, so a restart within the window does
+		// not overwrite the earlier part.
+		fn := scheduledName(output, time.Now())
+		log.Printf("Recording to %v until %v.\n", fn, end.Format(time.Kitchen))
+		rctx, cancel := context.WithDeadline(ctx, end)
+		if err := d.Download(rctx, uri, fn); err != nil {
+			log.Print(err)
+		}
+		cancel()
+		if time.Now().Before(end) {
+			// The stream ended or failed early. Try again within the window.
+			waitUntil(ctx, time.Now().Add(time.Minute))
+		}
+	}
+}
+
+// waitUntil returns true at t, or false if ctx is done first.
+func waitUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// scheduledName adds the start time of a recording to fn, e.g.
+// show-2024-05-06T1800.ts, so each window gets its own file.
+func scheduledName(fn string, start time.Time) string {
+	if fn == "-" {
+		return fn
+	}
+	ext := filepath.Ext(fn)
+	return fmt.Sprintf("%v-%v%v", fn[:len(fn)-len(ext)], start.Format("2006-01-02T1504"), ext)
+}
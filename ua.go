@@ -0,0 +1,52 @@
+/*
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+
+package main
+
+import "fmt"
+import "sort"
+import "strings"
+
+// User-Agent strings of common browsers and players, since some CDNs only
+// serve streams to clients they recognize.
+var uaPresets = map[string]string{
+	"chrome":  "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/128.0.0.0 Safari/537.36",
+	"firefox": "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:130.0) Gecko/20100101 Firefox/130.0",
+	"safari":  "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.6 Safari/605.1.15",
+	"ios":     "Mozilla/5.0 (iPhone; CPU iPhone OS 17_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.6 Mobile/15E148 Safari/604.1",
+	"android": "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/128.0.0.0 Mobile Safari/537.36",
+	"vlc":     "VLC/3.0.21 LibVLC/3.0.21",
+	"ffmpeg":  "Lavf/61.1.100",
+}
+
+func uaPresetNames() string {
+	var names []string
+	for name := range uaPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// uaPreset returns the User-Agent string for a preset name.
+func uaPreset(name string) (string, error) {
+	ua, ok := uaPresets[strings.ToLower(name)]
+	if !ok {
+		return "", fmt.Errorf("Unknown User-Agent preset %q (known: %v)", name, uaPresetNames())
+	}
+	return ua, nil
+}